@@ -8,12 +8,14 @@ import (
 	"html/template"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"strings"
 
 	"github.com/favclip/ucon"
 	"github.com/ory/fosite"
 	"github.com/vvakame/fosite-datastore-storage/example/domains"
+	fdsstorage "github.com/vvakame/fosite-datastore-storage/v2"
 )
 
 func SetupIDP(mux *ucon.ServeMux) {
@@ -109,6 +111,7 @@ func (h *handlers) TokenEndpoint(ctx context.Context, r *http.Request, w http.Re
 		log.Fatal(err)
 	}
 
+	ctx = clientAuthContext(ctx, r)
 	accessRequest, err := h.Provider.NewAccessRequest(ctx, r, sessionData)
 	if err != nil {
 		h.Provider.WriteAccessError(w, accessRequest, err)
@@ -133,6 +136,7 @@ func (h *handlers) TokenEndpoint(ctx context.Context, r *http.Request, w http.Re
 }
 
 func (h *handlers) RevokeEndpoint(ctx context.Context, r *http.Request, w http.ResponseWriter) {
+	ctx = clientAuthContext(ctx, r)
 	err := h.Provider.NewRevocationRequest(ctx, r)
 	h.Provider.WriteRevocationResponse(w, err)
 }
@@ -143,6 +147,7 @@ func (h *handlers) IntrospectEndpoint(ctx context.Context, r *http.Request, w ht
 		log.Fatal(err)
 	}
 
+	ctx = clientAuthContext(ctx, r)
 	ir, err := h.Provider.NewIntrospectionRequest(ctx, r, sessionData)
 	if err != nil {
 		h.Provider.WriteIntrospectionError(w, err)
@@ -151,3 +156,12 @@ func (h *handlers) IntrospectEndpoint(ctx context.Context, r *http.Request, w ht
 
 	h.Provider.WriteIntrospectionResponse(w, ir)
 }
+
+// clientAuthContext returns the context for the client authentication with the rate limit.
+func clientAuthContext(ctx context.Context, r *http.Request) context.Context {
+	ctx = fdsstorage.WithClientAuthentication(ctx)
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ctx = fdsstorage.WithClientIP(ctx, host)
+	}
+	return ctx
+}
@@ -19,6 +19,7 @@ import (
 	"go.mercari.io/datastore"
 	"go.mercari.io/datastore/clouddatastore"
 	"go.mercari.io/datastore/dsmiddleware/dslog"
+	"golang.org/x/xerrors"
 )
 
 var baseURL string
@@ -61,12 +62,17 @@ func ProvideStore(dsCli datastore.Client) (fdsstorage.Storage, error) {
 		DatastoreClient: func(ctx context.Context) (datastore.Client, error) {
 			return dsCli, nil
 		},
-		AuthenticateUser: func(ctx context.Context, name, secret string) error {
-			if name == "vvakame" && secret == "foobar" {
-				return nil
-			}
-			return fosite.ErrNotFound
+		UseUserStore: true,
+		RateLimiter: &fdsstorage.RateLimiterOptions{
+			User:   &fdsstorage.RateLimitPolicy{Limit: 10, Window: 10 * time.Minute},
+			Client: &fdsstorage.RateLimitPolicy{Limit: 10, Window: 10 * time.Minute},
+			IP:     &fdsstorage.RateLimitPolicy{Limit: 100, Window: 10 * time.Minute},
 		},
+		JWKSResolverOptions: &fdsstorage.JWKSResolverOptions{
+			Timeout: 5 * time.Second,
+		},
+		// register my-client at every boot.
+		AllowClientOverwrite: true,
 	})
 	if err != nil {
 		return nil, err
@@ -92,6 +98,12 @@ func ProvideStore(dsCli datastore.Client) (fdsstorage.Storage, error) {
 		return nil, err
 	}
 
+	// register vvakame / foobar for password grant.
+	err = store.CreateUser(ctx, "vvakame", "foobar")
+	if err != nil && !xerrors.Is(err, fdsstorage.ErrUserAlreadyExists) {
+		return nil, err
+	}
+
 	return store, nil
 }
 
@@ -136,6 +148,15 @@ func ProvideOAuth2Provider(config *compose.Config, store fdsstorage.Storage, str
 		compose.OpenIDConnectHybridFactory,
 		compose.OpenIDConnectRefreshFactory,
 	)
+	if f, ok := provider.(*fosite.Fosite); ok {
+		// accept rotated client secrets and limit failures of the client authentication.
+		// pass the context by clientAuthContext.
+		f.Hasher = &fdsstorage.ClientAuthHasher{Storage: store, Hasher: f.Hasher}
+		// resolve jwks_uri of private_key_jwt clients with the cache in Datastore.
+		// fosite doesn't pass the request context to the strategy, so it is bound to the context that lives as long as the process.
+		// each resolution is bounded by JWKSResolverOptions.Timeout instead of the request.
+		f.JWKSFetcherStrategy = store.JWKSFetcherStrategy(context.Background())
+	}
 	return provider, nil
 }
 
@@ -0,0 +1,149 @@
+package fdsstorage
+
+import (
+	"context"
+
+	"go.mercari.io/datastore"
+)
+
+// dsAccessor reads and writes entities of Datastore.
+// it works in the transaction if the context has it, so callers don't have to care about BeginTX.
+type dsAccessor struct {
+	ctx    context.Context
+	client datastore.Client
+	tx     datastore.Transaction
+	// namespace is applied to all keys and queries.
+	namespace string
+}
+
+// accessor returns dsAccessor bound to ctx.
+func (s *datastoreStorage) accessor(ctx context.Context) (*dsAccessor, error) {
+	dsCli, err := s.datastoreClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := txFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var namespace string
+	if s.namespace != nil {
+		namespace = s.namespace(ctx)
+	}
+
+	return &dsAccessor{
+		ctx:       ctx,
+		client:    dsCli,
+		tx:        tx,
+		namespace: namespace,
+	}, nil
+}
+
+// NoTx returns dsAccessor that ignores the transaction.
+// it is for bulk operations that exceed the limits of a transaction.
+func (a *dsAccessor) NoTx() *dsAccessor {
+	return &dsAccessor{
+		ctx:       a.ctx,
+		client:    a.client,
+		namespace: a.namespace,
+	}
+}
+
+// InTx reports whether the accessor works in the transaction.
+func (a *dsAccessor) InTx() bool {
+	return a.tx != nil
+}
+
+func (a *dsAccessor) NameKey(kind string, name string, parent datastore.Key) datastore.Key {
+	key := a.client.NameKey(kind, name, parent)
+	if a.namespace != "" {
+		key.SetNamespace(a.namespace)
+	}
+	return key
+}
+
+func (a *dsAccessor) NewQuery(kind string) datastore.Query {
+	q := a.client.NewQuery(kind)
+	if a.namespace != "" {
+		q = q.Namespace(a.namespace)
+	}
+	return q
+}
+
+func (a *dsAccessor) Get(key datastore.Key, dst interface{}) error {
+	if a.tx != nil {
+		return a.tx.Get(key, dst)
+	}
+	return a.client.Get(a.ctx, key, dst)
+}
+
+func (a *dsAccessor) GetMulti(keys []datastore.Key, dst interface{}) error {
+	if a.tx != nil {
+		return a.tx.GetMulti(keys, dst)
+	}
+	return a.client.GetMulti(a.ctx, keys, dst)
+}
+
+func (a *dsAccessor) Put(key datastore.Key, src interface{}) error {
+	if a.tx != nil {
+		_, err := a.tx.Put(key, src)
+		return err
+	}
+	_, err := a.client.Put(a.ctx, key, src)
+	return err
+}
+
+func (a *dsAccessor) PutMulti(keys []datastore.Key, src interface{}) error {
+	if a.tx != nil {
+		_, err := a.tx.PutMulti(keys, src)
+		return err
+	}
+	_, err := a.client.PutMulti(a.ctx, keys, src)
+	return err
+}
+
+func (a *dsAccessor) Delete(key datastore.Key) error {
+	if a.tx != nil {
+		return a.tx.Delete(key)
+	}
+	return a.client.Delete(a.ctx, key)
+}
+
+func (a *dsAccessor) DeleteMulti(keys []datastore.Key) error {
+	if a.tx != nil {
+		return a.tx.DeleteMulti(keys)
+	}
+	return a.client.DeleteMulti(a.ctx, keys)
+}
+
+// NewAncestorQuery returns the ancestor query, it joins the transaction of the accessor.
+func (a *dsAccessor) NewAncestorQuery(kind string, ancestor datastore.Key) datastore.Query {
+	q := a.NewQuery(kind).Ancestor(ancestor)
+	if a.tx != nil {
+		q = q.Transaction(a.tx)
+	}
+	return q
+}
+
+// GetAll runs the query. queries don't join the transaction because Datastore accepts only ancestor queries in it, see NewAncestorQuery.
+func (a *dsAccessor) GetAll(q datastore.Query, dst interface{}) ([]datastore.Key, error) {
+	return a.client.GetAll(a.ctx, q, dst)
+}
+
+// Run runs the query. see GetAll about the transaction.
+func (a *dsAccessor) Run(q datastore.Query) datastore.Iterator {
+	return a.client.Run(a.ctx, q)
+}
+
+func (a *dsAccessor) DecodeCursor(s string) (datastore.Cursor, error) {
+	return a.client.DecodeCursor(s)
+}
+
+// RunInTransaction runs f in the transaction of the accessor, or in a new transaction if it has no transaction.
+func (a *dsAccessor) RunInTransaction(f func(tx datastore.Transaction) error) error {
+	if a.tx != nil {
+		return f(a.tx)
+	}
+	_, err := a.client.RunInTransaction(a.ctx, f)
+	return err
+}
@@ -0,0 +1,204 @@
+package fdsstorage
+
+import (
+	"context"
+
+	"github.com/ory/fosite"
+	"go.mercari.io/datastore"
+	"golang.org/x/xerrors"
+)
+
+// GetMultiRequesters gets the requests of the kind by ids in batch.
+// The result is aligned with ids. When some items are failed, it returns MultiError that is also aligned with ids;
+// missing items are reported as fosite.ErrNotFound and invalidated items as fosite.ErrInvalidatedAuthorizeCode.
+func (s *datastoreStorage) GetMultiRequesters(ctx context.Context, kind string, ids []string) ([]fosite.Requester, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	acc, err := s.accessor(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([][]string, len(ids))
+	keys := make([]datastore.Key, len(ids))
+	for idx, id := range ids {
+		names[idx] = s.requestKeyNames(kind, id)
+		keys[idx] = acc.NameKey(kind, names[idx][0], nil)
+	}
+
+	requests, errs, err := s.getRequestersByKeys(ctx, acc, kind, keys)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range ids {
+		if !xerrors.Is(errs[idx], datastore.ErrNoSuchEntity) {
+			continue
+		}
+		errs[idx] = fosite.ErrNotFound
+		if len(names[idx]) > 1 {
+			// the entity may be stored under the name derived by previous key.
+			requests[idx], _, errs[idx] = s.getRequestEntityByNames(ctx, kind, names[idx][1:], nil)
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return requests, errs
+		}
+	}
+
+	return requests, nil
+}
+
+// getRequestersByKeys loads the requests of the keys by the requester of Config.NewRequester in batch.
+// the result and MultiError are aligned with keys, missing items are reported as datastore.ErrNoSuchEntity.
+// clients of the requests are also loaded in batch.
+func (s *datastoreStorage) getRequestersByKeys(ctx context.Context, acc *dsAccessor, kind string, keys []datastore.Key) ([]fosite.Requester, MultiError, error) {
+	psList := make([]datastore.PropertyList, len(keys))
+	errs := make(MultiError, len(keys))
+	err := acc.GetMulti(keys, psList)
+	if merr, ok := err.(datastore.MultiError); ok {
+		for idx, err := range merr {
+			errs[idx] = err
+		}
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	requests := make([]fosite.Requester, len(keys))
+	dsts := make([]interface{}, len(keys))
+	for idx := range keys {
+		if errs[idx] != nil {
+			continue
+		}
+
+		request := s.newRequester()
+		dst, err := s.requestEntityDst(request)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = loadPropertyList(ctx, dst, psList[idx])
+		if err != nil {
+			errs[idx] = err
+			continue
+		}
+		requests[idx] = request
+		dsts[idx] = dst
+	}
+
+	var clientIDs []string
+	for _, dst := range dsts {
+		var clientID string
+		switch v := dst.(type) {
+		case *DefaultRequester:
+			clientID = v.ClientID
+		case ClientLoader:
+			clientID = v.GetClientID()
+		default:
+			continue
+		}
+		// the request without the client, e.g. stored on migration, doesn't need to load it.
+		if clientID != "" {
+			clientIDs = appendUnique(clientIDs, clientID)
+		}
+	}
+	clients, clientErrs, err := s.getMultiClients(ctx, clientIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	getClient := func(id string) (fosite.Client, error) {
+		if client, ok := clients[id]; ok {
+			return client, nil
+		}
+		if err, ok := clientErrs[id]; ok {
+			return nil, err
+		}
+		return nil, fosite.ErrNotFound
+	}
+
+	for idx, dst := range dsts {
+		if dst == nil {
+			continue
+		}
+		requests[idx], errs[idx] = s.completeRequestEntity(ctx, kind, requests[idx], dst, nil, getClient)
+	}
+
+	return requests, errs, nil
+}
+
+// getMultiClients gets the clients by ids in batch.
+// The clients found in the client cache are not fetched from datastore.
+func (s *datastoreStorage) getMultiClients(ctx context.Context, ids []string) (map[string]fosite.Client, map[string]error, error) {
+	clients := make(map[string]fosite.Client, len(ids))
+	clientErrs := make(map[string]error)
+
+	var fetchIDs []string
+	for _, id := range ids {
+		if client, ok := s.getCachedClient(ctx, id); ok {
+			clients[id] = client
+			continue
+		}
+		fetchIDs = appendUnique(fetchIDs, id)
+	}
+	if len(fetchIDs) == 0 {
+		return clients, clientErrs, nil
+	}
+
+	acc, err := s.accessor(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := make([]datastore.Key, len(fetchIDs))
+	for idx, id := range fetchIDs {
+		keys[idx] = acc.NameKey(s.ClientKind, id, nil)
+	}
+	psList := make([]datastore.PropertyList, len(fetchIDs))
+	err = acc.GetMulti(keys, psList)
+	merr, isMulti := err.(datastore.MultiError)
+	if err != nil && !isMulti {
+		return nil, nil, err
+	}
+
+	for idx, id := range fetchIDs {
+		if isMulti && merr[idx] != nil {
+			if xerrors.Is(merr[idx], datastore.ErrNoSuchEntity) {
+				clientErrs[id] = fosite.ErrNotFound
+			} else {
+				clientErrs[id] = merr[idx]
+			}
+			continue
+		}
+
+		ps := psList[idx]
+		key := keys[idx]
+		client, err := s.loadClient(func(dst interface{}) error {
+			// the client ID is restored from the key, GetMulti into PropertyList doesn't do it.
+			if loader, ok := dst.(datastore.KeyLoader); ok {
+				err := loader.LoadKey(ctx, key)
+				if err != nil {
+					return err
+				}
+			}
+			return loadPropertyList(ctx, dst, ps)
+		})
+		if err != nil {
+			clientErrs[id] = err
+			continue
+		}
+		s.setCachedClient(ctx, id, client)
+		clients[id] = client
+	}
+
+	return clients, clientErrs, nil
+}
+
+// loadPropertyList loads ps into dst.
+func loadPropertyList(ctx context.Context, dst interface{}, ps datastore.PropertyList) error {
+	if pls, ok := dst.(datastore.PropertyLoadSaver); ok {
+		return pls.Load(ctx, ps)
+	}
+	return datastore.LoadStruct(ctx, dst, ps)
+}
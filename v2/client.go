@@ -14,6 +14,65 @@ var _ fosite.Client = (*DefaultClient)(nil)
 var _ fosite.OpenIDConnectClient = (*DefaultClient)(nil)
 var _ datastore.KeyLoader = (*DefaultClient)(nil)
 var _ datastore.PropertyLoadSaver = (*DefaultClient)(nil)
+var _ EncrypterSetter = (*DefaultClient)(nil)
+var _ ResponseModeClient = (*DefaultClient)(nil)
+var _ RotatedSecretsClient = (*DefaultClient)(nil)
+var _ TokenLifespanClient = (*DefaultClient)(nil)
+var _ SecretRotator = (*DefaultClient)(nil)
+
+// ResponseModeClient provides response modes the client is allowed to use.
+type ResponseModeClient interface {
+	GetResponseModes() []string
+}
+
+// RotatedSecretsClient provides hashed secrets that are still accepted after the rotation.
+// it is same as the interface of newer fosite, see also AuthenticateClientSecret.
+type RotatedSecretsClient interface {
+	GetRotatedHashes() [][]byte
+}
+
+// SecretRotator provides an action to replace the hashed secret of the client.
+type SecretRotator interface {
+	// RotateSecret replaces the secret by newHash, the old secret is accepted until now + gracePeriod.
+	RotateSecret(newHash []byte, now time.Time, gracePeriod time.Duration)
+}
+
+// ClientSecret is the hashed secret of the client with its validity period.
+type ClientSecret struct {
+	Hash        string    `datastore:",noindex"`
+	ActivatedAt time.Time `datastore:",noindex"`
+	// ExpiresAt is the end of the grace period. zero means never expires.
+	ExpiresAt time.Time `datastore:",noindex"`
+}
+
+// IsValid reports whether the secret is valid at the time.
+func (secret *ClientSecret) IsValid(now time.Time) bool {
+	if now.Before(secret.ActivatedAt) {
+		return false
+	}
+	return secret.ExpiresAt.IsZero() || now.Before(secret.ExpiresAt)
+}
+
+// TokenLifespanClient provides token lifespans of the client for each grant.
+type TokenLifespanClient interface {
+	// GetEffectiveLifespan returns the lifespan of the token issued by the grant, or fallback if it isn't set.
+	GetEffectiveLifespan(grantType string, tokenType fosite.TokenType, fallback time.Duration) time.Duration
+}
+
+// ClientLifespans holds token lifespans for each grant. zero value means the default lifespan.
+type ClientLifespans struct {
+	AuthorizationCodeGrantAccessTokenLifespan  time.Duration ``
+	AuthorizationCodeGrantIDTokenLifespan      time.Duration ``
+	AuthorizationCodeGrantRefreshTokenLifespan time.Duration ``
+	ClientCredentialsGrantAccessTokenLifespan  time.Duration ``
+	ImplicitGrantAccessTokenLifespan           time.Duration ``
+	ImplicitGrantIDTokenLifespan               time.Duration ``
+	PasswordGrantAccessTokenLifespan           time.Duration ``
+	PasswordGrantRefreshTokenLifespan          time.Duration ``
+	RefreshTokenGrantIDTokenLifespan           time.Duration ``
+	RefreshTokenGrantAccessTokenLifespan       time.Duration ``
+	RefreshTokenGrantRefreshTokenLifespan      time.Duration ``
+}
 
 // DefaultClient is a simple default implementation of the Client interface for Datastore.
 // It's support fosite.Client and fosite.OpenIDConnectClient interface.
@@ -27,16 +86,28 @@ type DefaultClient struct {
 	Scopes        []string ``
 	Audience      []string ``
 	Public        bool     ``
+	ResponseModes []string ``
+	// SecretActivatedAt is the time when Secret is set by RotateSecret.
+	SecretActivatedAt time.Time ``
+	// RotatedSecrets are hashed secrets that are still accepted after the rotation.
+	RotatedSecrets []ClientSecret  `json:"-"`
+	Lifespans      ClientLifespans ``
 	// for fosite.OpenIDConnectClient
 	JSONWebKeysURI                string              ``
 	JSONWebKeysJSON               string              `json:"-" datastore:",noindex"`
+	JSONWebKeysKeyID              string              `json:"-"` // not empty if JSONWebKeysJSON is encrypted
 	JSONWebKeys                   *jose.JSONWebKeySet `datastore:"-"`
 	TokenEndpointAuthMethod       string              ``
 	RequestURIs                   []string            ``
 	RequestObjectSigningAlgorithm string              ``
+	// TokenEndpointAuthSigningAlgorithm is empty on clients stored before the field is added, it means RS256.
+	TokenEndpointAuthSigningAlgorithm string ``
 	// others...
-	UpdatedAt time.Time ``
-	CreatedAt time.Time ``
+	SchemaVersion int       ``
+	UpdatedAt     time.Time ``
+	CreatedAt     time.Time ``
+
+	Encrypter Encrypter `json:"-" datastore:"-"`
 }
 
 // LoadKey is restore Client ID from Datastore key.
@@ -47,12 +118,24 @@ func (cli *DefaultClient) LoadKey(ctx context.Context, key datastore.Key) error
 
 // Load loads all of the provided properties into *DefaultClient.
 func (cli *DefaultClient) Load(ctx context.Context, ps []datastore.Property) error {
-	err := datastore.LoadStruct(ctx, cli, ps)
+	ps, err := upgradeSchema(ctx, clientSchemaUpgrades, ps)
+	if err != nil {
+		return err
+	}
+	err = datastore.LoadStruct(ctx, cli, ps)
 	if err != nil {
 		return err
 	}
 
-	if cli.JSONWebKeysJSON != "" {
+	if cli.JSONWebKeysKeyID != "" && cli.Encrypter != nil {
+		cli.JSONWebKeysJSON, err = decryptString(ctx, cli.Encrypter, cli.JSONWebKeysKeyID, cli.JSONWebKeysJSON)
+		if err != nil {
+			return err
+		}
+		cli.JSONWebKeysKeyID = ""
+	}
+
+	if cli.JSONWebKeysJSON != "" && cli.JSONWebKeysKeyID == "" {
 		var jwks jose.JSONWebKeySet
 		err = json.Unmarshal([]byte(cli.JSONWebKeysJSON), &jwks)
 		if err != nil {
@@ -77,13 +160,32 @@ func (cli *DefaultClient) Save(ctx context.Context) ([]datastore.Property, error
 			return nil, err
 		}
 		cli.JSONWebKeysJSON = string(b)
-	} else {
+		cli.JSONWebKeysKeyID = ""
+	} else if cli.JSONWebKeysKeyID == "" {
 		cli.JSONWebKeysJSON = ""
 	}
+	// JSONWebKeysJSON is kept as is if it is encrypted and not decrypted by Load.
+	cli.SchemaVersion = clientSchemaVersion
+
+	if cli.Encrypter != nil && cli.JSONWebKeysKeyID == "" && cli.JSONWebKeysJSON != "" {
+		// cli keeps plaintext, only saved properties are encrypted.
+		encrypted := *cli
+		var err error
+		encrypted.JSONWebKeysKeyID, encrypted.JSONWebKeysJSON, err = encryptString(ctx, cli.Encrypter, cli.JSONWebKeysJSON)
+		if err != nil {
+			return nil, err
+		}
+		return datastore.SaveStruct(ctx, &encrypted)
+	}
 
 	return datastore.SaveStruct(ctx, cli)
 }
 
+// SetEncrypter to specified value.
+func (cli *DefaultClient) SetEncrypter(encrypter Encrypter) {
+	cli.Encrypter = encrypter
+}
+
 // GetID returns the client ID.
 func (cli *DefaultClient) GetID() string {
 	return cli.ID
@@ -141,7 +243,7 @@ func (cli *DefaultClient) GetRequestURIs() []string {
 
 // GetJSONWebKeys returns the JSON Web Key Set containing the public keys used by the client to authenticate.
 func (cli *DefaultClient) GetJSONWebKeys() *jose.JSONWebKeySet {
-	return nil
+	return cli.JSONWebKeys
 }
 
 // GetJSONWebKeysURI returns the URL for lookup of JSON Web Key Set containing the
@@ -165,5 +267,112 @@ func (cli *DefaultClient) GetTokenEndpointAuthMethod() string {
 // GetTokenEndpointAuthSigningAlgorithm returns JWS [JWS] alg algorithm [JWA] that MUST be used for signing the JWT [JWT] used to authenticate the
 // Client at the Token Endpoint for the private_key_jwt and client_secret_jwt authentication methods.
 func (cli *DefaultClient) GetTokenEndpointAuthSigningAlgorithm() string {
-	return "RS256"
+	if cli.TokenEndpointAuthSigningAlgorithm == "" {
+		return "RS256"
+	}
+	return cli.TokenEndpointAuthSigningAlgorithm
+}
+
+// GetResponseModes returns the response modes the client is allowed to use.
+func (cli *DefaultClient) GetResponseModes() []string {
+	return cli.ResponseModes
+}
+
+// CloneClient returns the copy of the client for ClientCache.
+func (cli *DefaultClient) CloneClient() fosite.Client {
+	cloned := *cli
+	cloned.Secret = cloneBytes(cli.Secret)
+	cloned.RedirectURIs = cloneStrings(cli.RedirectURIs)
+	cloned.GrantTypes = cloneStrings(cli.GrantTypes)
+	cloned.ResponseTypes = cloneStrings(cli.ResponseTypes)
+	cloned.Scopes = cloneStrings(cli.Scopes)
+	cloned.Audience = cloneStrings(cli.Audience)
+	cloned.ResponseModes = cloneStrings(cli.ResponseModes)
+	if cli.RotatedSecrets != nil {
+		cloned.RotatedSecrets = append([]ClientSecret{}, cli.RotatedSecrets...)
+	}
+	cloned.JSONWebKeys = cloneJSONWebKeySet(cli.JSONWebKeys)
+	cloned.RequestURIs = cloneStrings(cli.RequestURIs)
+	return &cloned
+}
+
+// GetRotatedHashes returns hashed secrets that are still accepted after the rotation.
+func (cli *DefaultClient) GetRotatedHashes() [][]byte {
+	now := time.Now()
+	var hashes [][]byte
+	for _, secret := range cli.RotatedSecrets {
+		if secret.IsValid(now) {
+			hashes = append(hashes, []byte(secret.Hash))
+		}
+	}
+	return hashes
+}
+
+// RotateSecret replaces the secret by newHash, the old secret is accepted until now + gracePeriod.
+// expired secrets are dropped at the same time.
+func (cli *DefaultClient) RotateSecret(newHash []byte, now time.Time, gracePeriod time.Duration) {
+	var secrets []ClientSecret
+	for _, secret := range cli.RotatedSecrets {
+		if secret.ExpiresAt.IsZero() || now.Before(secret.ExpiresAt) {
+			secrets = append(secrets, secret)
+		}
+	}
+	if len(cli.Secret) != 0 && 0 < gracePeriod {
+		secrets = append(secrets, ClientSecret{
+			Hash:        string(cli.Secret),
+			ActivatedAt: cli.SecretActivatedAt,
+			ExpiresAt:   now.Add(gracePeriod),
+		})
+	}
+
+	cli.Secret = newHash
+	cli.SecretActivatedAt = now
+	cli.RotatedSecrets = secrets
+}
+
+// GetEffectiveLifespan returns the lifespan of the token issued by the grant, or fallback if it isn't set.
+func (cli *DefaultClient) GetEffectiveLifespan(grantType string, tokenType fosite.TokenType, fallback time.Duration) time.Duration {
+	var lifespan time.Duration
+	switch grantType {
+	case "authorization_code":
+		switch tokenType {
+		case fosite.AccessToken:
+			lifespan = cli.Lifespans.AuthorizationCodeGrantAccessTokenLifespan
+		case fosite.IDToken:
+			lifespan = cli.Lifespans.AuthorizationCodeGrantIDTokenLifespan
+		case fosite.RefreshToken:
+			lifespan = cli.Lifespans.AuthorizationCodeGrantRefreshTokenLifespan
+		}
+	case "client_credentials":
+		if tokenType == fosite.AccessToken {
+			lifespan = cli.Lifespans.ClientCredentialsGrantAccessTokenLifespan
+		}
+	case "implicit":
+		switch tokenType {
+		case fosite.AccessToken:
+			lifespan = cli.Lifespans.ImplicitGrantAccessTokenLifespan
+		case fosite.IDToken:
+			lifespan = cli.Lifespans.ImplicitGrantIDTokenLifespan
+		}
+	case "password":
+		switch tokenType {
+		case fosite.AccessToken:
+			lifespan = cli.Lifespans.PasswordGrantAccessTokenLifespan
+		case fosite.RefreshToken:
+			lifespan = cli.Lifespans.PasswordGrantRefreshTokenLifespan
+		}
+	case "refresh_token":
+		switch tokenType {
+		case fosite.AccessToken:
+			lifespan = cli.Lifespans.RefreshTokenGrantAccessTokenLifespan
+		case fosite.IDToken:
+			lifespan = cli.Lifespans.RefreshTokenGrantIDTokenLifespan
+		case fosite.RefreshToken:
+			lifespan = cli.Lifespans.RefreshTokenGrantRefreshTokenLifespan
+		}
+	}
+	if lifespan == 0 {
+		return fallback
+	}
+	return lifespan
 }
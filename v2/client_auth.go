@@ -0,0 +1,88 @@
+package fdsstorage
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/ory/fosite"
+)
+
+var _ fosite.Hasher = (*ClientAuthHasher)(nil)
+
+type contextClientAuthKey struct{}
+
+// clientAuthState holds the client loaded by GetClient during the client authentication.
+type clientAuthState struct {
+	client fosite.Client
+}
+
+// WithClientAuthentication returns the context for the client authentication by fosite.
+// GetClient remembers the client in it, and ClientAuthHasher uses it to limit failures of the client.
+// pass it to NewAccessRequest, NewRevocationRequest and NewIntrospectionRequest.
+func WithClientAuthentication(ctx context.Context) context.Context {
+	return context.WithValue(ctx, contextClientAuthKey{}, &clientAuthState{})
+}
+
+func clientAuthStateFromContext(ctx context.Context) *clientAuthState {
+	state, _ := ctx.Value(contextClientAuthKey{}).(*clientAuthState)
+	return state
+}
+
+// rememberClient remembers the client loaded by GetClient for ClientAuthHasher.
+func rememberClient(ctx context.Context, client fosite.Client) {
+	if state := clientAuthStateFromContext(ctx); state != nil {
+		state.client = client
+	}
+}
+
+// ClientAuthHasher is fosite.Hasher for the client authentication with rotated secrets and RateLimiterOptions.Client and IP.
+// set it to fosite.Fosite.Hasher, and use the context made by WithClientAuthentication.
+// it accepts the rotated secrets of RotatedSecretsClient, fosite v0.29 compares only GetHashedSecret.
+// it rejects the attempt by ErrRateLimited while the client or the IP address is limited,
+// and records the failure by RecordClientAuthFailure. fosite responds both as invalid_client.
+type ClientAuthHasher struct {
+	Storage Storage
+	// Hasher compares secrets. e.g. &fosite.BCrypt{WorkFactor: 12}
+	Hasher fosite.Hasher
+}
+
+// Hash hashes data by Hasher.
+func (h *ClientAuthHasher) Hash(ctx context.Context, data []byte) ([]byte, error) {
+	return h.Hasher.Hash(ctx, data)
+}
+
+// Compare compares data with hash and the rotated secrets of the client by Hasher with the rate limit of the client.
+func (h *ClientAuthHasher) Compare(ctx context.Context, hash, data []byte) error {
+	var client fosite.Client
+	if state := clientAuthStateFromContext(ctx); state != nil && state.client != nil && bytes.Equal(state.client.GetHashedSecret(), hash) {
+		client = state.client
+	}
+	var clientID string
+	if client != nil {
+		clientID = client.GetID()
+	}
+
+	err := h.Storage.CheckClientAuthRateLimit(ctx, clientID)
+	if err != nil {
+		return err
+	}
+
+	compare := func(hash, data []byte) error {
+		return h.Hasher.Compare(ctx, hash, data)
+	}
+	var authErr error
+	if client != nil {
+		authErr = AuthenticateClientSecret(client, data, compare)
+	} else {
+		authErr = compare(hash, data)
+	}
+	if authErr == nil {
+		return nil
+	}
+
+	err = h.Storage.RecordClientAuthFailure(ctx, clientID)
+	if err != nil {
+		return err
+	}
+	return authErr
+}
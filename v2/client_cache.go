@@ -0,0 +1,208 @@
+package fdsstorage
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+	"github.com/ory/fosite"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var _ ClientCache = (*LRUClientCache)(nil)
+var _ ClientCloner = (*DefaultClient)(nil)
+
+// ClientCache caches clients loaded by GetClient.
+// implement it to use Redis, memcache and others.
+type ClientCache interface {
+	Get(ctx context.Context, id string) (fosite.Client, bool)
+	Set(ctx context.Context, id string, client fosite.Client)
+	Delete(ctx context.Context, id string)
+}
+
+// ClientCloner provides a copy of the client that shares no mutable values with the original.
+// ClientCache holds copies so callers can't modify the cached clients. clients that don't implement it aren't cached,
+// except DefaultClient, fosite.DefaultClient and fosite.DefaultOpenIDConnectClient.
+type ClientCloner interface {
+	CloneClient() fosite.Client
+}
+
+// ClientCacheStats provides counters of ClientCache for monitoring.
+type ClientCacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// LRUClientCache is in-process ClientCache with LRU eviction and TTL.
+type LRUClientCache struct {
+	cache *lru.Cache
+	ttl   time.Duration
+}
+
+type lruClientCacheEntry struct {
+	client    fosite.Client
+	expiresAt time.Time
+}
+
+// NewLRUClientCache returns LRUClientCache which holds up to size clients for ttl.
+func NewLRUClientCache(size int, ttl time.Duration) (*LRUClientCache, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &LRUClientCache{
+		cache: cache,
+		ttl:   ttl,
+	}, nil
+}
+
+// Get returns the cached client if it isn't expired.
+func (c *LRUClientCache) Get(ctx context.Context, id string) (fosite.Client, bool) {
+	v, ok := c.cache.Get(id)
+	if !ok {
+		return nil, false
+	}
+	entry := v.(*lruClientCacheEntry)
+	if !time.Now().Before(entry.expiresAt) {
+		c.cache.Remove(id)
+		return nil, false
+	}
+	return entry.client, true
+}
+
+// Set the client.
+func (c *LRUClientCache) Set(ctx context.Context, id string, client fosite.Client) {
+	c.cache.Add(id, &lruClientCacheEntry{
+		client:    client,
+		expiresAt: time.Now().Add(c.ttl),
+	})
+}
+
+// Delete the client.
+func (c *LRUClientCache) Delete(ctx context.Context, id string) {
+	c.cache.Remove(id)
+}
+
+// ClientCacheStats returns hit and miss counts of Config.ClientCache.
+func (s *datastoreStorage) ClientCacheStats() ClientCacheStats {
+	return ClientCacheStats{
+		Hits:   atomic.LoadUint64(&s.clientCacheHits),
+		Misses: atomic.LoadUint64(&s.clientCacheMisses),
+	}
+}
+
+// clientCacheKey returns the key of ClientCache for the client. it is qualified by the namespace of ctx.
+func (s *datastoreStorage) clientCacheKey(ctx context.Context, id string) string {
+	if s.namespace == nil {
+		return id
+	}
+	ns := s.namespace(ctx)
+	if ns == "" {
+		return id
+	}
+	return ns + "\x00" + id
+}
+
+// getCachedClient returns the copy of the cached client.
+func (s *datastoreStorage) getCachedClient(ctx context.Context, id string) (fosite.Client, bool) {
+	if s.clientCache == nil {
+		return nil, false
+	}
+	client, ok := s.clientCache.Get(ctx, s.clientCacheKey(ctx, id))
+	if ok {
+		client, ok = cloneClient(client)
+	}
+	if !ok {
+		atomic.AddUint64(&s.clientCacheMisses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&s.clientCacheHits, 1)
+	return client, true
+}
+
+// setCachedClient caches the copy of the client.
+func (s *datastoreStorage) setCachedClient(ctx context.Context, id string, client fosite.Client) {
+	if s.clientCache == nil {
+		return
+	}
+	client, ok := cloneClient(client)
+	if !ok {
+		return
+	}
+	s.clientCache.Set(ctx, s.clientCacheKey(ctx, id), client)
+}
+
+// invalidateCachedClient deletes the cached client.
+// in the transaction, it is deferred until the transaction is committed, otherwise GetClient may cache the old one again.
+func (s *datastoreStorage) invalidateCachedClient(ctx context.Context, id string) {
+	if s.clientCache == nil {
+		return
+	}
+	key := s.clientCacheKey(ctx, id)
+	if txCtx, ok := activeTxContext(ctx); ok {
+		txCtx.state.onCommit(func() {
+			s.clientCache.Delete(ctx, key)
+		})
+		return
+	}
+	s.clientCache.Delete(ctx, key)
+}
+
+// cloneClient returns the copy of the client. it returns false if the client can't be copied.
+func cloneClient(client fosite.Client) (fosite.Client, bool) {
+	switch v := client.(type) {
+	case ClientCloner:
+		return v.CloneClient(), true
+
+	case *fosite.DefaultClient:
+		return cloneFositeDefaultClient(v), true
+
+	case *fosite.DefaultOpenIDConnectClient:
+		cloned := *v
+		if v.DefaultClient != nil {
+			cloned.DefaultClient = cloneFositeDefaultClient(v.DefaultClient)
+		}
+		cloned.JSONWebKeys = cloneJSONWebKeySet(v.JSONWebKeys)
+		cloned.RequestURIs = cloneStrings(v.RequestURIs)
+		return &cloned, true
+
+	default:
+		return nil, false
+	}
+}
+
+func cloneFositeDefaultClient(client *fosite.DefaultClient) *fosite.DefaultClient {
+	cloned := *client
+	cloned.Secret = cloneBytes(client.Secret)
+	cloned.RedirectURIs = cloneStrings(client.RedirectURIs)
+	cloned.GrantTypes = cloneStrings(client.GrantTypes)
+	cloned.ResponseTypes = cloneStrings(client.ResponseTypes)
+	cloned.Scopes = cloneStrings(client.Scopes)
+	cloned.Audience = cloneStrings(client.Audience)
+	return &cloned
+}
+
+func cloneJSONWebKeySet(jwks *jose.JSONWebKeySet) *jose.JSONWebKeySet {
+	if jwks == nil {
+		return nil
+	}
+	// the keys themselves are immutable.
+	return &jose.JSONWebKeySet{
+		Keys: append([]jose.JSONWebKey(nil), jwks.Keys...),
+	}
+}
+
+func cloneStrings(list []string) []string {
+	if list == nil {
+		return nil
+	}
+	return append([]string{}, list...)
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
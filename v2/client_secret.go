@@ -0,0 +1,70 @@
+package fdsstorage
+
+import (
+	"context"
+	"time"
+
+	"github.com/ory/fosite"
+	"go.mercari.io/datastore"
+	"golang.org/x/xerrors"
+)
+
+// RotateClientSecret replaces the hashed secret of the client by newHash.
+// the old secret is still accepted for gracePeriod through RotatedSecretsClient, e.g. by ClientAuthHasher.
+// it fails with gracePeriod if the client of Config.NewClientEntity doesn't implement RotatedSecretsClient,
+// e.g. *fosite.DefaultClient, because the old secret would be rejected at once.
+func (s *datastoreStorage) RotateClientSecret(ctx context.Context, clientID string, newHash []byte, gracePeriod time.Duration) error {
+	if _, ok := s.newClientEntity().(RotatedSecretsClient); !ok && 0 < gracePeriod {
+		return errClientNeedsRotatedSecrets
+	}
+
+	acc, err := s.accessor(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer s.invalidateCachedClient(ctx, clientID)
+
+	key := acc.NameKey(s.ClientKind, clientID, nil)
+	return acc.RunInTransaction(func(tx datastore.Transaction) error {
+		cliEntity, err := s.clientEntityDst()
+		if err != nil {
+			return err
+		}
+		err = tx.Get(key, cliEntity)
+		if xerrors.Is(err, datastore.ErrNoSuchEntity) {
+			return fosite.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+
+		rotator, ok := cliEntity.(SecretRotator)
+		if !ok {
+			return errClientNeedsSecretRotator
+		}
+		rotator.RotateSecret(newHash, time.Now(), gracePeriod)
+
+		_, err = tx.Put(key, cliEntity)
+		return err
+	})
+}
+
+// AuthenticateClientSecret compares the secret with the hashed secret of the client and its rotated secrets.
+// fosite v0.29 compares only GetHashedSecret, ClientAuthHasher uses it to accept rotated secrets.
+// e.g. AuthenticateClientSecret(client, secret, bcrypt.CompareHashAndPassword)
+func AuthenticateClientSecret(client fosite.Client, secret []byte, compare func(hash, secret []byte) error) error {
+	err := compare(client.GetHashedSecret(), secret)
+	if err == nil {
+		return nil
+	}
+
+	if rotated, ok := client.(RotatedSecretsClient); ok {
+		for _, hash := range rotated.GetRotatedHashes() {
+			if compare(hash, secret) == nil {
+				return nil
+			}
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"strings"
+
+	"github.com/ory/fosite"
+	fdsstorage "github.com/vvakame/fosite-datastore-storage/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var clientsCommand = &command{
+	name:  "clients",
+	usage: "list, show, create and delete clients",
+	run:   runClients,
+}
+
+// clientSummary is the client without its secret.
+type clientSummary struct {
+	ID                      string   `json:"id"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	Scopes                  []string `json:"scopes"`
+	Audience                []string `json:"audience"`
+	Public                  bool     `json:"public"`
+	JSONWebKeysURI          string   `json:"jwks_uri,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+}
+
+func newClientSummary(client fosite.Client) *clientSummary {
+	summary := &clientSummary{
+		ID:            client.GetID(),
+		RedirectURIs:  client.GetRedirectURIs(),
+		GrantTypes:    client.GetGrantTypes(),
+		ResponseTypes: client.GetResponseTypes(),
+		Scopes:        client.GetScopes(),
+		Audience:      client.GetAudience(),
+		Public:        client.IsPublic(),
+	}
+	if oidcClient, ok := client.(fosite.OpenIDConnectClient); ok {
+		summary.JSONWebKeysURI = oidcClient.GetJSONWebKeysURI()
+		summary.TokenEndpointAuthMethod = oidcClient.GetTokenEndpointAuthMethod()
+	}
+	return summary
+}
+
+func runClients(ctx context.Context, env *environment, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: clients list|show|create|delete")
+	}
+
+	switch args[0] {
+	case "list":
+		return runClientsList(ctx, env, args[1:])
+	case "show":
+		return runClientsShow(ctx, env, args[1:])
+	case "create":
+		return runClientsCreate(ctx, env, args[1:])
+	case "delete":
+		return runClientsDelete(ctx, env, args[1:])
+	default:
+		return errors.New("usage: clients list|show|create|delete")
+	}
+}
+
+func runClientsList(ctx context.Context, env *environment, args []string) error {
+	fs := flag.NewFlagSet("clients list", flag.ExitOnError)
+	limit := fs.Int("limit", 100, "number of clients per page")
+	cursor := fs.String("cursor", "", "cursor of the page")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	clients, next, err := env.store.ListClients(ctx, *cursor, *limit)
+	if err != nil {
+		return err
+	}
+	summaries := make([]*clientSummary, 0, len(clients))
+	for _, client := range clients {
+		summaries = append(summaries, newClientSummary(client))
+	}
+
+	return printJSON(map[string]interface{}{
+		"clients": summaries,
+		"cursor":  next,
+	})
+}
+
+func runClientsShow(ctx context.Context, env *environment, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: clients show <client id>")
+	}
+
+	client, err := env.store.GetClient(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	return printJSON(newClientSummary(client))
+}
+
+func runClientsCreate(ctx context.Context, env *environment, args []string) error {
+	fs := flag.NewFlagSet("clients create", flag.ExitOnError)
+	id := fs.String("id", "", "client ID")
+	secret := fs.String("secret", "", "client secret, it is stored as bcrypt hash. empty means public client")
+	redirectURIs := fs.String("redirect-uri", "", "comma separated redirect URIs")
+	grantTypes := fs.String("grant-type", "authorization_code,refresh_token", "comma separated grant types")
+	responseTypes := fs.String("response-type", "code", "comma separated response types")
+	scopes := fs.String("scope", "openid,offline", "comma separated scopes")
+	audience := fs.String("audience", "", "comma separated audience")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *id == "" {
+		return errors.New("-id is required")
+	}
+
+	client := &fdsstorage.DefaultClient{
+		ID:            *id,
+		RedirectURIs:  splitList(*redirectURIs),
+		GrantTypes:    splitList(*grantTypes),
+		ResponseTypes: splitList(*responseTypes),
+		Scopes:        splitList(*scopes),
+		Audience:      splitList(*audience),
+		Public:        *secret == "",
+	}
+	if *secret != "" {
+		client.Secret, err = bcrypt.GenerateFromPassword([]byte(*secret), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = env.store.CreateClient(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(newClientSummary(client))
+}
+
+func runClientsDelete(ctx context.Context, env *environment, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: clients delete <client id>")
+	}
+
+	return env.store.DeleteClient(ctx, args[0])
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+
+	"go.mercari.io/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// redactedValue replaces hashed secrets in dumped entities.
+const redactedValue = "REDACTED"
+
+// redactedProperties are properties holding hashed secrets. e.g. DefaultClient.Secret, User.PasswordHash.
+// the hash of RotatedSecrets is stored as nested entity, or flattened "RotatedSecrets.Hash".
+var redactedProperties = map[string]bool{
+	"Secret":              true,
+	"Hash":                true,
+	"RotatedSecrets.Hash": true,
+	"PasswordHash":        true,
+}
+
+var dumpCommand = &command{
+	name:  "dump",
+	usage: "dump entities of the kind as JSON",
+	run:   runDump,
+}
+
+func runDump(ctx context.Context, env *environment, args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	kind := fs.String("kind", "", "kind to dump")
+	limit := fs.Int("limit", 0, "maximum number of entities. 0 means all")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *kind == "" {
+		return errors.New("-kind is required")
+	}
+
+	q := env.newQuery(*kind)
+	if *limit > 0 {
+		q = q.Limit(*limit)
+	}
+
+	// properties are dumped as stored except hashed secrets, encrypted values are not decrypted.
+	entities := make([]map[string]interface{}, 0)
+	it := env.dsCli.Run(ctx, q)
+	for {
+		var ps datastore.PropertyList
+		key, err := it.Next(&ps)
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		entity := map[string]interface{}{
+			"__key__": key.String(),
+		}
+		for _, p := range ps {
+			entity[p.Name] = redactProperty(p)
+		}
+		entities = append(entities, entity)
+	}
+
+	return printJSON(entities)
+}
+
+// redactProperty returns the value of p, or redactedValue if p holds hashed secrets.
+func redactProperty(p datastore.Property) interface{} {
+	if redactedProperties[p.Name] {
+		if _, ok := p.Value.([]interface{}); ok {
+			return []interface{}{redactedValue}
+		}
+		return redactedValue
+	}
+
+	switch v := p.Value.(type) {
+	case *datastore.Entity:
+		return redactEntity(v)
+	case []interface{}:
+		values := make([]interface{}, 0, len(v))
+		for _, elem := range v {
+			if e, ok := elem.(*datastore.Entity); ok {
+				values = append(values, redactEntity(e))
+			} else {
+				values = append(values, elem)
+			}
+		}
+		return values
+	default:
+		return p.Value
+	}
+}
+
+// redactEntity returns properties of the nested entity with hashed secrets redacted.
+func redactEntity(e *datastore.Entity) map[string]interface{} {
+	entity := make(map[string]interface{}, len(e.Properties))
+	for _, p := range e.Properties {
+		entity[p.Name] = redactProperty(p)
+	}
+	return entity
+}
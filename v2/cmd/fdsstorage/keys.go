@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	fdsstorage "github.com/vvakame/fosite-datastore-storage/v2"
+)
+
+// derivedNameSampleSize is the number of key names checked by checkKeyNames for each kind.
+const derivedNameSampleSize = 20
+
+// hmacKeyFile is the JSON file given by -hmac-key-file.
+//
+//	{
+//	  "keys": [
+//	    {"id": "key2", "secret": "base64 encoded secret"},
+//	    {"id": "key1", "secret": "base64 encoded secret"}
+//	  ],
+//	  "fallback_to_raw_key": true
+//	}
+type hmacKeyFile struct {
+	Keys []struct {
+		ID     string `json:"id"`
+		Secret []byte `json:"secret"`
+	} `json:"keys"`
+	FallbackToRawKey bool `json:"fallback_to_raw_key"`
+}
+
+// loadKeyNameDeriver returns HMACKeyNameDeriver from the JSON file.
+func loadKeyNameDeriver(path string) (*fdsstorage.HMACKeyNameDeriver, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &hmacKeyFile{}
+	err = json.Unmarshal(b, file)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Keys) == 0 {
+		return nil, fmt.Errorf("no keys in %s", path)
+	}
+
+	deriver := &fdsstorage.HMACKeyNameDeriver{
+		FallbackToRawKey: file.FallbackToRawKey,
+	}
+	for _, key := range file.Keys {
+		if key.ID == "" || strings.Contains(key.ID, ":") || len(key.Secret) == 0 {
+			return nil, fmt.Errorf("invalid key %q in %s", key.ID, path)
+		}
+		deriver.Keys = append(deriver.Keys, &fdsstorage.HMACKey{
+			ID:     key.ID,
+			Secret: key.Secret,
+		})
+	}
+
+	return deriver, nil
+}
+
+// loadEncrypter returns EnvelopeEncrypter with the key file of FileKeyProvider.
+func loadEncrypter(path string) (fdsstorage.Encrypter, error) {
+	provider, err := fdsstorage.NewFileKeyProvider(path)
+	if err != nil {
+		return nil, err
+	}
+	return &fdsstorage.EnvelopeEncrypter{KeyProvider: provider}, nil
+}
+
+// checkKeyNames refuses to look up by signature when request entities are stored by derived key names
+// but no KeyNameDeriver is given. otherwise every token is reported as not found.
+func checkKeyNames(ctx context.Context, env *environment) error {
+	if env.config.KeyNameDeriver != nil {
+		return nil
+	}
+
+	for _, kind := range env.requestKinds() {
+		keys, err := env.dsCli.GetAll(ctx, env.newQuery(kind).KeysOnly().Limit(derivedNameSampleSize), nil)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if isDerivedKeyName(key.Name()) {
+				return errors.New("request entities are stored by derived key names. -hmac-key-file is required")
+			}
+		}
+	}
+
+	return nil
+}
+
+// isDerivedKeyName reports whether the name is formatted like the one made by HMACKeyNameDeriver.
+func isDerivedKeyName(name string) bool {
+	idx := strings.Index(name, ":")
+	if idx == -1 {
+		return false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(name[idx+1:])
+	return err == nil && len(b) == sha256.Size
+}
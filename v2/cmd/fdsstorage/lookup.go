@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"time"
+
+	"github.com/ory/fosite"
+	fdsstorage "github.com/vvakame/fosite-datastore-storage/v2"
+	"golang.org/x/xerrors"
+)
+
+var lookupCommand = &command{
+	name:  "lookup",
+	usage: "look up requests by signature or request ID across all kinds",
+	run:   runLookup,
+}
+
+// requestSummary is the request without its session.
+type requestSummary struct {
+	Kind            string    `json:"kind"`
+	KeyName         string    `json:"key_name,omitempty"`
+	ID              string    `json:"request_id"`
+	ClientID        string    `json:"client_id"`
+	Subject         string    `json:"subject"`
+	RequestedAt     time.Time `json:"requested_at"`
+	GrantedScope    []string  `json:"granted_scope"`
+	GrantedAudience []string  `json:"granted_audience"`
+	Active          bool      `json:"active"`
+	ExpiresAt       time.Time `json:"expires_at,omitempty"`
+}
+
+func runLookup(ctx context.Context, env *environment, args []string) error {
+	fs := flag.NewFlagSet("lookup", flag.ExitOnError)
+	signature := fs.String("signature", "", "signature of the token, or the authorize code")
+	requestID := fs.String("request-id", "", "request ID")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var summaries []*requestSummary
+	switch {
+	case *signature != "":
+		err = checkKeyNames(ctx, env)
+		if err != nil {
+			return err
+		}
+		summaries, err = lookupBySignature(ctx, env, *signature)
+	case *requestID != "":
+		summaries, err = lookupByRequestID(ctx, env, *requestID)
+	default:
+		return errors.New("-signature or -request-id is required")
+	}
+	if err != nil {
+		return err
+	}
+
+	return printJSON(summaries)
+}
+
+func lookupBySignature(ctx context.Context, env *environment, signature string) ([]*requestSummary, error) {
+	summaries := make([]*requestSummary, 0)
+	for _, kind := range env.requestKinds() {
+		active := true
+		requests, err := env.store.GetMultiRequesters(ctx, kind, []string{signature})
+		if merr, ok := err.(fdsstorage.MultiError); ok {
+			err = merr[0]
+		}
+		if xerrors.Is(err, fosite.ErrNotFound) {
+			continue
+		} else if xerrors.Is(err, fosite.ErrInvalidatedAuthorizeCode) {
+			active = false
+		} else if err != nil {
+			return nil, err
+		}
+
+		request := requests[0]
+		summary := &requestSummary{
+			Kind:            kind,
+			ID:              request.GetID(),
+			RequestedAt:     request.GetRequestedAt(),
+			GrantedScope:    request.GetGrantedScopes(),
+			GrantedAudience: request.GetGrantedAudience(),
+			Active:          active,
+		}
+		if client := request.GetClient(); client != nil {
+			summary.ClientID = client.GetID()
+		}
+		if session := request.GetSession(); session != nil {
+			summary.Subject = session.GetSubject()
+		}
+		if modifier, ok := request.(fdsstorage.ExpiresAtModifier); ok {
+			summary.ExpiresAt = modifier.GetExpiresAt()
+		}
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, nil
+}
+
+func lookupByRequestID(ctx context.Context, env *environment, requestID string) ([]*requestSummary, error) {
+	summaries := make([]*requestSummary, 0)
+	for _, kind := range env.requestKinds() {
+		q := env.newQuery(kind).Filter("ID =", requestID)
+		var reqEntities []*fdsstorage.DefaultRequester
+		keys, err := env.dsCli.GetAll(ctx, q, &reqEntities)
+		if err != nil {
+			return nil, err
+		}
+
+		for idx, reqEntity := range reqEntities {
+			summaries = append(summaries, &requestSummary{
+				Kind:            kind,
+				KeyName:         keys[idx].Name(),
+				ID:              reqEntity.ID,
+				ClientID:        reqEntity.ClientID,
+				Subject:         reqEntity.Subject,
+				RequestedAt:     reqEntity.RequestedAt,
+				GrantedScope:    reqEntity.GrantedScope,
+				GrantedAudience: reqEntity.GrantedAudience,
+				Active:          reqEntity.Active,
+				ExpiresAt:       reqEntity.ExpiresAt,
+			})
+		}
+	}
+
+	return summaries, nil
+}
@@ -0,0 +1,178 @@
+// Command fdsstorage is the admin tool for entities stored by fosite-datastore-storage.
+//
+// it connects to Cloud Datastore of DATASTORE_PROJECT_ID, or the emulator if DATASTORE_EMULATOR_HOST is set.
+// if the storage is configured with Encrypter or KeyNameDeriver, give the same keys by
+// -encryption-key-file (FDSSTORAGE_ENCRYPTION_KEY_FILE) and -hmac-key-file (FDSSTORAGE_HMAC_KEY_FILE).
+//
+//	fdsstorage clients list
+//	fdsstorage clients create -id my-client -secret foobar -redirect-uri http://localhost:8080/callback
+//	fdsstorage lookup -signature xxxx
+//	fdsstorage revoke -request-id xxxx
+//	fdsstorage purge -before 2019-05-01T00:00:00Z
+//	fdsstorage dump -kind FositeClient
+//	fdsstorage migrate -cursor-file cursors.json
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	cloudds "cloud.google.com/go/datastore"
+	fdsstorage "github.com/vvakame/fosite-datastore-storage/v2"
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/clouddatastore"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, env *environment, args []string) error
+}
+
+var commands = []*command{
+	clientsCommand,
+	lookupCommand,
+	revokeCommand,
+	purgeCommand,
+	dumpCommand,
+	migrateCommand,
+}
+
+// environment holds the storage and settings shared by commands.
+type environment struct {
+	dsCli     datastore.Client
+	store     fdsstorage.Storage
+	config    *fdsstorage.Config
+	namespace string
+}
+
+// requestKinds returns all kinds of request entities.
+func (env *environment) requestKinds() []string {
+	return []string{
+		env.config.AuthorizeCodeKind,
+		env.config.IDSessionKind,
+		env.config.AccessTokenKind,
+		env.config.RefreshTokenKind,
+		env.config.PKCEKind,
+	}
+}
+
+// newQuery returns the query scoped by the namespace.
+func (env *environment) newQuery(kind string) datastore.Query {
+	q := env.dsCli.NewQuery(kind)
+	if env.namespace != "" {
+		q = q.Namespace(env.namespace)
+	}
+	return q
+}
+
+func main() {
+	log.SetFlags(0)
+
+	config := &fdsstorage.Config{}
+	namespace := flag.String("namespace", "", "Datastore namespace")
+	flag.StringVar(&config.ClientKind, "client-kind", "FositeClient", "kind of clients")
+	flag.StringVar(&config.AuthorizeCodeKind, "authorize-code-kind", "FositeAuthorizeCode", "kind of authorize codes")
+	flag.StringVar(&config.IDSessionKind, "id-session-kind", "FositeIDSession", "kind of OpenID Connect sessions")
+	flag.StringVar(&config.AccessTokenKind, "access-token-kind", "FositeAccessToken", "kind of access tokens")
+	flag.StringVar(&config.RefreshTokenKind, "refresh-token-kind", "FositeRefreshToken", "kind of refresh tokens")
+	flag.StringVar(&config.PKCEKind, "pkce-kind", "FositePKCE", "kind of PKCE requests")
+	encryptionKeyFile := flag.String("encryption-key-file", os.Getenv("FDSSTORAGE_ENCRYPTION_KEY_FILE"), "JSON file of FileKeyProvider to decrypt entities")
+	hmacKeyFile := flag.String("hmac-key-file", os.Getenv("FDSSTORAGE_HMAC_KEY_FILE"), "JSON file of HMAC keys to derive key names of requests")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	var cmd *command
+	for _, c := range commands {
+		if c.name == flag.Arg(0) {
+			cmd = c
+			break
+		}
+	}
+	if cmd == nil {
+		usage()
+		os.Exit(2)
+	}
+
+	if *encryptionKeyFile != "" {
+		encrypter, err := loadEncrypter(*encryptionKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.Encrypter = encrypter
+	}
+	if *hmacKeyFile != "" {
+		deriver, err := loadKeyNameDeriver(*hmacKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.KeyNameDeriver = deriver
+	}
+
+	ctx := context.Background()
+	env, err := newEnvironment(ctx, config, *namespace)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = cmd.run(ctx, env, flag.Args()[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: fdsstorage [flags] <command> [arguments]\n\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(flag.CommandLine.Output(), "\t%-10s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(flag.CommandLine.Output(), "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func newEnvironment(ctx context.Context, config *fdsstorage.Config, namespace string) (*environment, error) {
+	// cloud datastore client uses DATASTORE_EMULATOR_HOST if it is set.
+	baseDsCli, err := cloudds.NewClient(ctx, os.Getenv("DATASTORE_PROJECT_ID"))
+	if err != nil {
+		return nil, err
+	}
+	dsCli, err := clouddatastore.FromClient(ctx, baseDsCli)
+	if err != nil {
+		return nil, err
+	}
+
+	config.DatastoreClient = func(ctx context.Context) (datastore.Client, error) {
+		return dsCli, nil
+	}
+	if namespace != "" {
+		config.Namespace = func(ctx context.Context) string {
+			return namespace
+		}
+	}
+	store, err := fdsstorage.NewStorage(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &environment{
+		dsCli:     dsCli,
+		store:     store,
+		config:    config,
+		namespace: namespace,
+	}, nil
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	fdsstorage "github.com/vvakame/fosite-datastore-storage/v2"
+)
+
+var migrateCommand = &command{
+	name:  "migrate",
+	usage: "rewrite entities to the latest schema version",
+	run:   runMigrate,
+}
+
+func runMigrate(ctx context.Context, env *environment, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	kinds := fs.String("kinds", "", "comma separated kinds to migrate. default is all kinds")
+	batchSize := fs.Int("batch", 0, "number of entities per batch")
+	cursorFile := fs.String("cursor-file", "", "file to save cursors, the migration resumes from it")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	opts := &fdsstorage.MigrateSchemaOptions{
+		BatchSize: *batchSize,
+		Cursors:   make(map[string]string),
+	}
+	if *kinds != "" {
+		opts.Kinds = strings.Split(*kinds, ",")
+	}
+	if *cursorFile != "" {
+		b, err := ioutil.ReadFile(*cursorFile)
+		if err == nil {
+			err = json.Unmarshal(b, &opts.Cursors)
+			if err != nil {
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	opts.Progress = func(kind string, cursor string, migrated int) {
+		log.Printf("%s: %d entities migrated", kind, migrated)
+		if *cursorFile == "" {
+			return
+		}
+		opts.Cursors[kind] = cursor
+		b, err := json.Marshal(opts.Cursors)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = ioutil.WriteFile(*cursorFile, b, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	counts, err := env.store.MigrateSchema(ctx, opts)
+	if err != nil {
+		return err
+	}
+	for kind, count := range counts {
+		log.Printf("%s: done, %d entities migrated", kind, count)
+	}
+
+	return nil
+}
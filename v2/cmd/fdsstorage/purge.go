@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"strings"
+	"time"
+
+	fdsstorage "github.com/vvakame/fosite-datastore-storage/v2"
+)
+
+var purgeCommand = &command{
+	name:  "purge",
+	usage: "delete expired requests",
+	run:   runPurge,
+}
+
+func runPurge(ctx context.Context, env *environment, args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	before := fs.String("before", "", "delete requests expired before the time in RFC 3339. default is now")
+	kinds := fs.String("kinds", "", "comma separated kinds to purge. default is all request kinds")
+	batchSize := fs.Int("batch", 0, "number of entities per batch")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	t := time.Now()
+	if *before != "" {
+		t, err = time.Parse(time.RFC3339, *before)
+		if err != nil {
+			return err
+		}
+	}
+	opts := &fdsstorage.PurgeOptions{
+		BatchSize: *batchSize,
+	}
+	if *kinds != "" {
+		opts.Kinds = strings.Split(*kinds, ",")
+	}
+
+	counts, err := env.store.PurgeExpired(ctx, t, opts)
+	for kind, count := range counts {
+		log.Printf("%s: %d entities deleted", kind, count)
+	}
+	return err
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+
+	fdsstorage "github.com/vvakame/fosite-datastore-storage/v2"
+)
+
+var revokeCommand = &command{
+	name:  "revoke",
+	usage: "revoke grants by request ID or subject",
+	run:   runRevoke,
+}
+
+func runRevoke(ctx context.Context, env *environment, args []string) error {
+	fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+	requestID := fs.String("request-id", "", "request ID of the grant")
+	subject := fs.String("subject", "", "revoke all grants of the subject")
+	clientID := fs.String("client", "", "limit -subject to grants of the client")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *requestID != "":
+		return env.store.RevokeRefreshToken(ctx, *requestID)
+	case *subject != "":
+		return env.store.RevokeAllForSubject(ctx, *subject, &fdsstorage.GrantOptions{
+			ClientID: *clientID,
+		})
+	default:
+		return errors.New("-request-id or -subject is required")
+	}
+}
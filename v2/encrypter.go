@@ -0,0 +1,195 @@
+package fdsstorage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+var _ Encrypter = (*EnvelopeEncrypter)(nil)
+var _ KeyProvider = (*FileKeyProvider)(nil)
+
+const dataKeySize = 32
+
+// Encrypter encrypts sensitive properties of entities. e.g. DefaultRequester.SessionJSON, DefaultClient.JSONWebKeysJSON.
+type Encrypter interface {
+	// Encrypt returns ciphertext and ID of the key that is needed to decrypt it.
+	Encrypt(ctx context.Context, plaintext []byte) (keyID string, ciphertext []byte, err error)
+	Decrypt(ctx context.Context, keyID string, ciphertext []byte) ([]byte, error)
+}
+
+// EncrypterSetter provides an action to set Encrypter for entities.
+type EncrypterSetter interface {
+	SetEncrypter(encrypter Encrypter)
+}
+
+// KeyProvider provides key encryption keys for EnvelopeEncrypter.
+type KeyProvider interface {
+	// CurrentKey returns the key which is used to encrypt new data.
+	CurrentKey(ctx context.Context) (keyID string, key []byte, err error)
+	// Key returns the key of keyID. old keys are kept to decrypt existing data after rotation.
+	Key(ctx context.Context, keyID string) ([]byte, error)
+}
+
+// EnvelopeEncrypter encrypts data by AES-GCM with random data key,
+// and the data key is encrypted by AES-GCM with the key encryption key from KeyProvider.
+// the key ID of the key encryption key is stored alongside the data, so keys can be rotated.
+type EnvelopeEncrypter struct {
+	KeyProvider KeyProvider
+}
+
+// Encrypt returns wrapped data key and ciphertext.
+func (e *EnvelopeEncrypter) Encrypt(ctx context.Context, plaintext []byte) (string, []byte, error) {
+	keyID, kek, err := e.KeyProvider.CurrentKey(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", nil, err
+	}
+
+	wrappedKey, err := sealAESGCM(kek, dataKey)
+	if err != nil {
+		return "", nil, err
+	}
+	ciphertext, err := sealAESGCM(dataKey, plaintext)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return keyID, append(wrappedKey, ciphertext...), nil
+}
+
+// Decrypt unwraps data key and decrypts ciphertext.
+func (e *EnvelopeEncrypter) Decrypt(ctx context.Context, keyID string, ciphertext []byte) ([]byte, error) {
+	kek, err := e.KeyProvider.Key(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	// nonce + data key + tag
+	wrappedKeySize := 12 + dataKeySize + 16
+	if len(ciphertext) < wrappedKeySize {
+		return nil, errors.WithStack(errInvalidCiphertext)
+	}
+	dataKey, err := openAESGCM(kek, ciphertext[:wrappedKeySize])
+	if err != nil {
+		return nil, err
+	}
+
+	return openAESGCM(dataKey, ciphertext[wrappedKeySize:])
+}
+
+func sealAESGCM(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openAESGCM(key, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.WithStack(errInvalidCiphertext)
+	}
+
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, nil)
+}
+
+// FileKeyProvider is KeyProvider loaded from local JSON file. it is intended for tests and local development.
+//
+//	{
+//	  "current": "key2",
+//	  "keys": {
+//	    "key1": "base64 encoded 16, 24 or 32 bytes key",
+//	    "key2": "base64 encoded 16, 24 or 32 bytes key"
+//	  }
+//	}
+type FileKeyProvider struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"`
+}
+
+// NewFileKeyProvider returns KeyProvider by given file path.
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := &FileKeyProvider{}
+	err = json.Unmarshal(b, provider)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := provider.Keys[provider.Current]; !ok {
+		return nil, errors.Errorf("current key %s is not found in %s", provider.Current, path)
+	}
+
+	return provider, nil
+}
+
+// CurrentKey returns the key specified by "current".
+func (p *FileKeyProvider) CurrentKey(ctx context.Context) (string, []byte, error) {
+	key, err := p.Key(ctx, p.Current)
+	if err != nil {
+		return "", nil, err
+	}
+	return p.Current, key, nil
+}
+
+// Key returns the key of keyID.
+func (p *FileKeyProvider) Key(ctx context.Context, keyID string) ([]byte, error) {
+	key, ok := p.Keys[keyID]
+	if !ok {
+		return nil, errors.Wrapf(errUnknownKeyID, "key ID: %s", keyID)
+	}
+	return key, nil
+}
+
+func encryptString(ctx context.Context, encrypter Encrypter, plaintext string) (keyID string, ciphertext string, err error) {
+	keyID, b, err := encrypter.Encrypt(ctx, []byte(plaintext))
+	if err != nil {
+		return "", "", err
+	}
+	return keyID, base64.StdEncoding.EncodeToString(b), nil
+}
+
+func decryptString(ctx context.Context, encrypter Encrypter, keyID string, ciphertext string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	b, err = encrypter.Decrypt(ctx, keyID, b)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -2,11 +2,93 @@ package fdsstorage
 
 import (
 	"errors"
+	"fmt"
+
+	"github.com/ory/fosite"
+	"golang.org/x/xerrors"
 )
 
 var errUnsupportedRequesterType = errors.New("requester type must be *fosite.Request or *fosite.AccessRequest or *fosite.AuthorizeRequest or datastore.PropertyLoadSaver")
 var errRequesterNeedsActiveStateModifier = errors.New("requester is not implement ActiveStateModifier")
 var errRequesterNeedsClientLoader = errors.New("requester is not implement ClientLoader")
+var errClientNeedsSecretRotator = errors.New("client is not implement SecretRotator")
+var errClientNeedsRotatedSecrets = errors.New("client is not implement RotatedSecretsClient, use DefaultClient to accept the old secret in the grace period")
 var errUnsupportedClientType = errors.New("client type must be *fosite.DefaultClient or *fosite.DefaultOpenIDConnectClient or datastore.PropertyLoadSaver")
 
 var errInvalidTxContext = errors.New("context doesn't in tx context")
+var errFinishedTxContext = errors.New("transaction of the context is already committed or rolled back")
+var errTxRollbackOnly = errors.New("transaction is rolled back because the joined context is rolled back")
+var errKeyNameDeriverRequired = errors.New("property KeyNameDeriver is required")
+
+var errInvalidPasswordHash = errors.New("invalid password hash")
+var errArgon2MemoryTooLarge = errors.New("memory of Argon2Hasher must be at most 1 GiB")
+
+var errInvalidCiphertext = errors.New("ciphertext is too short")
+var errUnknownKeyID = errors.New("unknown key ID")
+
+// ErrClientAlreadyExists is returned by CreateClient when the client ID is already used.
+var ErrClientAlreadyExists = errors.New("client already exists")
+
+// ErrRefreshTokenReused is the reason of the error returned by GetRefreshTokenSession when the already rotated refresh token is presented.
+// all tokens issued from the same request are revoked at that time.
+// the error is reported to fosite as fosite.ErrNotFound, use xerrors.Is to tell it.
+var ErrRefreshTokenReused = errors.New("refresh token is already rotated")
+
+// ErrUserAlreadyExists is returned by CreateUser when the user name is already used.
+var ErrUserAlreadyExists = errors.New("user already exists")
+
+// ErrUserLocked is returned by Authenticate while the user is locked out by consecutive failures.
+// it is wrapped as fosite.ErrNotFound. use xerrors.Is to tell it from a wrong password.
+var ErrUserLocked = errors.New("user is locked out")
+
+// ErrPasswordMismatch is returned by PasswordHasher when the password doesn't match the hash.
+var ErrPasswordMismatch = errors.New("password mismatch")
+
+// notFoundError is reported to fosite handlers as fosite.ErrNotFound, and keeps the reason for xerrors.Is.
+// fosite v0.29 checks errors of the storage by errors.Cause, and treats others as server_error.
+type notFoundError struct {
+	reason error
+}
+
+// wrapNotFound returns the error that is fosite.ErrNotFound by the reason.
+func wrapNotFound(reason error) error {
+	return &notFoundError{reason: reason}
+}
+
+func (e *notFoundError) Error() string {
+	return e.reason.Error()
+}
+
+// Cause returns fosite.ErrNotFound for errors.Cause of github.com/pkg/errors.
+func (e *notFoundError) Cause() error {
+	return fosite.ErrNotFound
+}
+
+// Is reports whether target is fosite.ErrNotFound or the reason.
+func (e *notFoundError) Is(target error) bool {
+	return target == fosite.ErrNotFound || xerrors.Is(e.reason, target)
+}
+
+// MultiError is returned by batch operations which continue after some errors.
+type MultiError []error
+
+func (m MultiError) Error() string {
+	s, n := "", 0
+	for _, e := range m {
+		if e != nil {
+			if n == 0 {
+				s = e.Error()
+			}
+			n++
+		}
+	}
+	switch n {
+	case 0:
+		return "(0 errors)"
+	case 1:
+		return s
+	case 2:
+		return s + " (and 1 other error)"
+	}
+	return fmt.Sprintf("%s (and %d other errors)", s, n-1)
+}
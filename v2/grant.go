@@ -0,0 +1,139 @@
+package fdsstorage
+
+import (
+	"context"
+	"time"
+
+	"github.com/ory/fosite"
+	"go.mercari.io/datastore"
+	"golang.org/x/xerrors"
+)
+
+// GrantOptions provides some settings for ListGrantsBySubject and RevokeAllForSubject.
+type GrantOptions struct {
+	// ClientID filters grants by client. empty means all clients.
+	ClientID string
+}
+
+// Grant represents live tokens issued from the same request for the subject.
+type Grant struct {
+	RequestID       string
+	ClientID        string
+	Subject         string
+	RequestedAt     time.Time
+	GrantedScope    []string
+	GrantedAudience []string
+	// Kinds that have live entities of this grant.
+	Kinds []string
+}
+
+// ListGrantsBySubject returns live grants of the subject.
+// it looks up access token, refresh token, OpenID Connect session and PKCE kinds by Subject property, that DefaultRequester stores.
+// the entities are loaded by the requester of Config.NewRequester, so custom requester types and session codecs are kept.
+func (s *datastoreStorage) ListGrantsBySubject(ctx context.Context, subject string, opts *GrantOptions) ([]*Grant, error) {
+	if opts == nil {
+		opts = &GrantOptions{}
+	}
+
+	acc, err := s.accessor(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	kinds := []string{
+		s.AccessTokenKind,
+		s.RefreshTokenKind,
+		s.IDSessionKind,
+		s.PKCEKind,
+	}
+
+	var grants []*Grant
+	grantMap := make(map[string]*Grant)
+	for _, kind := range kinds {
+		q := acc.NewQuery(kind).Filter("Subject =", subject).KeysOnly()
+		if opts.ClientID != "" {
+			q = q.Filter("ClientID =", opts.ClientID)
+		}
+		keys, err := acc.GetAll(q, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for len(keys) != 0 {
+			size := len(keys)
+			if deleteBatchSize < size {
+				size = deleteBatchSize
+			}
+			requests, errs, err := s.getRequestersByKeys(ctx, acc, kind, keys[:size])
+			if err != nil {
+				return nil, err
+			}
+			keys = keys[size:]
+
+			for idx, request := range requests {
+				err := errs[idx]
+				if xerrors.Is(err, fosite.ErrNotFound) || xerrors.Is(err, fosite.ErrInvalidatedAuthorizeCode) || xerrors.Is(err, datastore.ErrNoSuchEntity) {
+					// expired, inactive or deleted after the query.
+					continue
+				} else if err != nil {
+					return nil, err
+				}
+
+				grant, ok := grantMap[request.GetID()]
+				if !ok {
+					grant = &Grant{
+						RequestID:   request.GetID(),
+						Subject:     subject,
+						RequestedAt: request.GetRequestedAt(),
+					}
+					if client := request.GetClient(); client != nil {
+						grant.ClientID = client.GetID()
+					}
+					grantMap[request.GetID()] = grant
+					grants = append(grants, grant)
+				}
+				grant.GrantedScope = appendUnique(grant.GrantedScope, request.GetGrantedScopes()...)
+				grant.GrantedAudience = appendUnique(grant.GrantedAudience, request.GetGrantedAudience()...)
+				grant.Kinds = appendUnique(grant.Kinds, kind)
+			}
+		}
+	}
+
+	return grants, nil
+}
+
+// RevokeAllForSubject revokes all live grants of the subject. a.k.a. "log out everywhere".
+func (s *datastoreStorage) RevokeAllForSubject(ctx context.Context, subject string, opts *GrantOptions) error {
+	grants, err := s.ListGrantsBySubject(ctx, subject, opts)
+	if err != nil {
+		return err
+	}
+
+	var errs MultiError
+	for _, grant := range grants {
+		err := s.RevokeRefreshToken(ctx, grant.RequestID)
+		if merr, ok := err.(MultiError); ok {
+			errs = append(errs, merr...)
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+func appendUnique(list []string, values ...string) []string {
+outer:
+	for _, v := range values {
+		for _, old := range list {
+			if v == old {
+				continue outer
+			}
+		}
+		list = append(list, v)
+	}
+	return list
+}
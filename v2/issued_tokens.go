@@ -0,0 +1,29 @@
+package fdsstorage
+
+import (
+	"context"
+
+	"github.com/ory/fosite"
+	"golang.org/x/xerrors"
+)
+
+// RevokeTokensByAuthorizeCode revokes the tokens issued from the authorize code if the code has been invalidated.
+// the tokens are looked up by the request ID, that is taken over from the authorize code to the tokens and to the refreshed ones.
+// see https://tools.ietf.org/html/rfc6749#section-4.1.2
+//
+// the tokens are found reliably only with RequestAncestorKeyLayout, that records them in the entity group of the request ID.
+// with FlatKeyLayout they are found by the global query, that is eventually consistent and may miss the tokens issued just before.
+//
+// fosite's authorize code handler already revokes them on the reuse by RevokeAccessToken and RevokeRefreshToken with the request ID.
+// call it when the code is presented outside of the handler, e.g. the custom token endpoint or the incident response.
+func (s *datastoreStorage) RevokeTokensByAuthorizeCode(ctx context.Context, code string) error {
+	request, err := s.getRequestEntity(ctx, s.AuthorizeCodeKind, code, nil)
+	if err == nil {
+		// the code is not used yet.
+		return nil
+	} else if !xerrors.Is(err, fosite.ErrInvalidatedAuthorizeCode) {
+		return err
+	}
+
+	return s.RevokeRefreshToken(ctx, request.GetID())
+}
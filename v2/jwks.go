@@ -0,0 +1,206 @@
+package fdsstorage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+	"golang.org/x/xerrors"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var _ fosite.JWKSFetcherStrategy = (*jwksFetcherStrategy)(nil)
+
+// JWKSResolverOptions provides some settings for resolving JSONWebKeysURI of clients.
+type JWKSResolverOptions struct {
+	// HTTPClient fetches JSON Web Key Sets. default is http.Client with 10 seconds timeout.
+	HTTPClient *http.Client
+	// MaxResponseSize is the maximum size of the JSON Web Key Set in bytes. default is 512 KiB.
+	// the key set is cached in an entity, keep it well below the entity size limit of 1 MiB.
+	MaxResponseSize int64
+	// Timeout bounds each resolution by JWKSFetcherStrategy, including Datastore access. default is 10 seconds.
+	Timeout time.Duration
+	// DefaultTTL is used when the response has no Cache-Control max-age. default is 1 hour.
+	DefaultTTL time.Duration
+	// MinRefreshInterval suppresses forced refreshes after the last fetch, e.g. by unknown key IDs. default is 1 minute.
+	MinRefreshInterval time.Duration
+}
+
+// jwksCacheEntry is the JSON Web Key Set cached in JWKSCacheKind. its key name is made by jwksCacheKeyName.
+type jwksCacheEntry struct {
+	Location   string    `datastore:",noindex"`
+	KeySetJSON string    `datastore:",noindex"`
+	ETag       string    `datastore:",noindex"`
+	FetchedAt  time.Time `datastore:",noindex"`
+	ExpiresAt  time.Time ``
+}
+
+// jwksCacheMaxKeyNameSize is the maximum size of the location used as the key name as is.
+// Datastore rejects key names over 1500 bytes.
+const jwksCacheMaxKeyNameSize = 1500
+
+// jwksCacheKeyName returns the location as is, or its SHA-256 hash if it is too long for the key name.
+func jwksCacheKeyName(location string) string {
+	if len(location) <= jwksCacheMaxKeyNameSize {
+		return location
+	}
+	sum := sha256.Sum256([]byte(location))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (entry *jwksCacheEntry) keySet() (*jose.JSONWebKeySet, error) {
+	var jwks jose.JSONWebKeySet
+	err := json.Unmarshal([]byte(entry.KeySetJSON), &jwks)
+	if err != nil {
+		return nil, err
+	}
+	return &jwks, nil
+}
+
+// ResolveJSONWebKeys returns the JSON Web Key Set at the location.
+// it is cached in JWKSCacheKind until the expiry, forceRefresh revalidates it by ETag.
+func (s *datastoreStorage) ResolveJSONWebKeys(ctx context.Context, location string, forceRefresh bool) (*jose.JSONWebKeySet, error) {
+	acc, err := s.accessor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the cache is shared, it must not be rolled back with the caller's transaction.
+	acc = acc.NoTx()
+
+	key := acc.NameKey(s.JWKSCacheKind, jwksCacheKeyName(location), nil)
+	entry := &jwksCacheEntry{}
+	err = acc.Get(key, entry)
+	if xerrors.Is(err, datastore.ErrNoSuchEntity) {
+		entry = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if entry != nil && now.Before(entry.ExpiresAt) {
+		if !forceRefresh || now.Sub(entry.FetchedAt) < s.jwksResolverOptions.MinRefreshInterval {
+			return entry.keySet()
+		}
+	}
+
+	entry, err = s.fetchJSONWebKeys(ctx, location, entry, now)
+	if err != nil {
+		return nil, err
+	}
+
+	err = acc.Put(key, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry.keySet()
+}
+
+// fetchJSONWebKeys fetches the JSON Web Key Set, cached is revalidated by If-None-Match if it is given.
+func (s *datastoreStorage) fetchJSONWebKeys(ctx context.Context, location string, cached *jwksCacheEntry, now time.Time) (*jwksCacheEntry, error) {
+	req, err := http.NewRequest(http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if cached != nil && cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+
+	resp, err := s.jwksResolverOptions.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	ttl := s.jwksResolverOptions.DefaultTTL
+	if maxAge, ok := cacheControlMaxAge(resp.Header.Get("Cache-Control")); ok {
+		ttl = maxAge
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		cached.FetchedAt = now
+		cached.ExpiresAt = now.Add(ttl)
+		return cached, nil
+
+	case resp.StatusCode == http.StatusOK:
+		maxSize := s.jwksResolverOptions.MaxResponseSize
+		b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if maxSize < int64(len(b)) {
+			return nil, errors.Errorf("JSON Web Key Set at %s exceeds %d bytes", location, maxSize)
+		}
+		var jwks jose.JSONWebKeySet
+		err = json.Unmarshal(b, &jwks)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid JSON Web Key Set at %s", location)
+		}
+		return &jwksCacheEntry{
+			Location:   location,
+			KeySetJSON: string(b),
+			ETag:       resp.Header.Get("ETag"),
+			FetchedAt:  now,
+			ExpiresAt:  now.Add(ttl),
+		}, nil
+
+	default:
+		return nil, errors.Errorf("unexpected status %d from %s", resp.StatusCode, location)
+	}
+}
+
+// cacheControlMaxAge returns max-age of Cache-Control. no-cache and no-store are treated as max-age=0.
+func cacheControlMaxAge(header string) (time.Duration, bool) {
+	for _, directive := range strings.Split(header, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-cache" || directive == "no-store" {
+			return 0, true
+		}
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+		if err != nil || seconds < 0 {
+			continue
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+// JWKSFetcherStrategy returns fosite.JWKSFetcherStrategy backed by ResolveJSONWebKeys.
+// fosite refreshes the key set by the strategy when the client's JSON Web Token has an unknown key ID.
+// fosite doesn't pass the request context to the strategy, so ctx is used for all resolutions,
+// and each one is bounded by JWKSResolverOptions.Timeout. give the context that lives as long as the provider.
+// Config.Namespace is resolved by ctx too, the cache of the strategy is shared by all tenants.
+// it is safe because the key set is cached by its location, that is the same for all tenants.
+// e.g. provider.(*fosite.Fosite).JWKSFetcherStrategy = store.JWKSFetcherStrategy(ctx)
+func (s *datastoreStorage) JWKSFetcherStrategy(ctx context.Context) fosite.JWKSFetcherStrategy {
+	return &jwksFetcherStrategy{ctx: ctx, s: s}
+}
+
+type jwksFetcherStrategy struct {
+	ctx context.Context
+	s   *datastoreStorage
+}
+
+// Resolve is called with ignoreCache=true when the key is not found in the cached key set.
+func (strategy *jwksFetcherStrategy) Resolve(location string, ignoreCache bool) (*jose.JSONWebKeySet, error) {
+	ctx, cancel := context.WithTimeout(strategy.ctx, strategy.s.jwksResolverOptions.Timeout)
+	defer cancel()
+
+	return strategy.s.ResolveJSONWebKeys(ctx, location, ignoreCache)
+}
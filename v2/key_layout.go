@@ -0,0 +1,173 @@
+package fdsstorage
+
+import (
+	"time"
+
+	"github.com/ory/fosite"
+	"go.mercari.io/datastore"
+	"golang.org/x/xerrors"
+)
+
+// KeyLayout decides how request entities are grouped in Datastore.
+type KeyLayout int
+
+const (
+	// FlatKeyLayout stores request entities as root entities.
+	// revocation finds them by global queries, that are eventually consistent.
+	FlatKeyLayout KeyLayout = iota
+	// RequestAncestorKeyLayout additionally records request entities as children of the per-request parent key.
+	// revocation finds them by ancestor queries, that are strongly consistent and work in the transaction.
+	// entities are still looked up by the flat key, and revocation also runs the global query for entities stored by FlatKeyLayout.
+	RequestAncestorKeyLayout
+)
+
+// requestGroupMember records the request entity in the entity group of the request.
+// it is deleted with the request entity, by DeleteClient through ClientID and by PurgeExpired through ExpiresAt.
+type requestGroupMember struct {
+	Kind      string    ``
+	Name      string    `datastore:",noindex"`
+	ClientID  string    ``
+	ExpiresAt time.Time ``
+	CreatedAt time.Time ``
+}
+
+// requestGroupKey returns the parent key of the entity group of the request.
+func (s *datastoreStorage) requestGroupKey(acc *dsAccessor, requestID string) datastore.Key {
+	return acc.NameKey(s.RequestGroupKind, requestID, nil)
+}
+
+// requestGroupMemberKey returns the key of requestGroupMember of the request entity.
+func (s *datastoreStorage) requestGroupMemberKey(acc *dsAccessor, kind string, name string, requestID string) datastore.Key {
+	return acc.NameKey(s.RequestGroupMemberKind, kind+":"+name, s.requestGroupKey(acc, requestID))
+}
+
+// putRequestGroupMember records the request entity in the entity group of the request.
+// it is called on every put of the request entity, so ExpiresAt follows the entity, e.g. on deactivation.
+func (s *datastoreStorage) putRequestGroupMember(acc *dsAccessor, kind string, name string, request fosite.Requester, expiresAt time.Time) error {
+	if s.keyLayout != RequestAncestorKeyLayout || request.GetID() == "" {
+		return nil
+	}
+
+	member := &requestGroupMember{
+		Kind:      kind,
+		Name:      name,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+	}
+	if client := request.GetClient(); client != nil {
+		member.ClientID = client.GetID()
+	} else if loader, ok := request.(ClientLoader); ok {
+		member.ClientID = loader.GetClientID()
+	}
+
+	return acc.Put(s.requestGroupMemberKey(acc, kind, name, request.GetID()), member)
+}
+
+// deleteRequestGroupMembers deletes requestGroupMember of the request entities stored by the names.
+// it reads the entities to know their request IDs, so call it before deleting them.
+func (s *datastoreStorage) deleteRequestGroupMembers(acc *dsAccessor, kind string, names []string) error {
+	if s.keyLayout != RequestAncestorKeyLayout {
+		return nil
+	}
+
+	var memberKeys []datastore.Key
+	for _, name := range names {
+		var ps datastore.PropertyList
+		err := acc.Get(acc.NameKey(kind, name, nil), &ps)
+		if xerrors.Is(err, datastore.ErrNoSuchEntity) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if requestID := requestIDOf(ps); requestID != "" {
+			memberKeys = append(memberKeys, s.requestGroupMemberKey(acc, kind, name, requestID))
+		}
+	}
+	if len(memberKeys) == 0 {
+		return nil
+	}
+
+	return acc.DeleteMulti(memberKeys)
+}
+
+// migrateRequestGroupMember renames requestGroupMember of the request entity moved by MigrateRequestKeys.
+func (s *datastoreStorage) migrateRequestGroupMember(acc *dsAccessor, tx datastore.Transaction, kind string, oldName string, newName string, ps datastore.PropertyList) error {
+	if s.keyLayout != RequestAncestorKeyLayout {
+		return nil
+	}
+	requestID := requestIDOf(ps)
+	if requestID == "" {
+		return nil
+	}
+
+	oldKey := s.requestGroupMemberKey(acc, kind, oldName, requestID)
+	member := &requestGroupMember{}
+	err := tx.Get(oldKey, member)
+	if xerrors.Is(err, datastore.ErrNoSuchEntity) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	member.Name = newName
+	_, err = tx.Put(s.requestGroupMemberKey(acc, kind, newName, requestID), member)
+	if err != nil {
+		return err
+	}
+	return tx.Delete(oldKey)
+}
+
+// requestIDOf returns ID property of the request entity.
+func requestIDOf(ps datastore.PropertyList) string {
+	for _, p := range ps {
+		if p.Name != "ID" {
+			continue
+		}
+		if requestID, ok := p.Value.(string); ok {
+			return requestID
+		}
+	}
+	return ""
+}
+
+// requestKeysByRequestID returns keys of the request entities of the kind that have the request ID.
+// memberKeys are keys of requestGroupMember, they are empty on FlatKeyLayout.
+func (s *datastoreStorage) requestKeysByRequestID(acc *dsAccessor, kind string, requestID string) (keys []datastore.Key, memberKeys []datastore.Key, err error) {
+	if s.keyLayout != RequestAncestorKeyLayout {
+		q := acc.NewQuery(kind).Filter("ID =", requestID).KeysOnly()
+		keys, err := acc.GetAll(q, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return keys, nil, nil
+	}
+
+	q := acc.NewAncestorQuery(s.RequestGroupMemberKind, s.requestGroupKey(acc, requestID))
+	var members []*requestGroupMember
+	allMemberKeys, err := acc.GetAll(q, &members)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := make(map[string]bool)
+	for idx, member := range members {
+		if member.Kind != kind {
+			continue
+		}
+		keys = append(keys, acc.NameKey(kind, member.Name, nil))
+		memberKeys = append(memberKeys, allMemberKeys[idx])
+		names[member.Name] = true
+	}
+
+	// entities stored before the layout is switched have no members.
+	q = acc.NewQuery(kind).Filter("ID =", requestID).KeysOnly()
+	flatKeys, err := acc.GetAll(q, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, key := range flatKeys {
+		if !names[key.Name()] {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, memberKeys, nil
+}
@@ -0,0 +1,215 @@
+package fdsstorage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+
+	"go.mercari.io/datastore"
+	"golang.org/x/xerrors"
+	"google.golang.org/api/iterator"
+)
+
+var _ KeyNameDeriver = (*HMACKeyNameDeriver)(nil)
+
+// KeyNameDeriver derives Datastore key names of request entities from token signatures or authorize codes.
+// it prevents replay of tokens by the person who can read Datastore (backups, exports, admin console).
+type KeyNameDeriver interface {
+	// DeriveKeyNames returns key names of id.
+	// the first one is used to store entities, the others are tried on load and delete to support key rotation.
+	DeriveKeyNames(kind string, id string) []string
+	// IsDerived reports whether the key name is in the derived format.
+	// it must be true for names derived by keys which are dropped already, they must not be derived again.
+	IsDerived(name string) bool
+}
+
+// HMACKey is a secret (pepper) of HMACKeyNameDeriver.
+type HMACKey struct {
+	// ID is embedded in the key name. it must not contain ":".
+	ID     string
+	Secret []byte
+}
+
+// HMACKeyNameDeriver derives key names by HMAC-SHA256.
+// key names are formatted as "{HMACKey.ID}:{base64url(HMAC-SHA256(kind + "\x00" + id))}".
+type HMACKeyNameDeriver struct {
+	// Keys are ordered newest first. the first key is used to store entities.
+	Keys []*HMACKey
+	// FallbackToRawKey makes load and delete try the raw value as key name too.
+	// set true until MigrateRequestKeys is finished.
+	FallbackToRawKey bool
+}
+
+// DeriveKeyNames returns key names made by each key.
+func (d *HMACKeyNameDeriver) DeriveKeyNames(kind string, id string) []string {
+	names := make([]string, 0, len(d.Keys)+1)
+	for _, key := range d.Keys {
+		mac := hmac.New(sha256.New, key.Secret)
+		_, _ = mac.Write([]byte(kind))
+		_, _ = mac.Write([]byte{0})
+		_, _ = mac.Write([]byte(id))
+		names = append(names, key.ID+":"+base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))
+	}
+	if d.FallbackToRawKey || len(names) == 0 {
+		names = append(names, id)
+	}
+	return names
+}
+
+// IsDerived reports whether the key name is formatted as "{ID}:{base64url(HMAC-SHA256)}".
+// the ID isn't checked against Keys, names derived by the dropped keys are derived too.
+func (d *HMACKeyNameDeriver) IsDerived(name string) bool {
+	idx := strings.Index(name, ":")
+	if idx <= 0 {
+		return false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(name[idx+1:])
+	return err == nil && len(b) == sha256.Size
+}
+
+// MigrateKeysOptions provides some settings for MigrateRequestKeys.
+type MigrateKeysOptions struct {
+	// Kinds to migrate. default is all request kinds (authorize code, OpenID Connect session, access token, refresh token and PKCE).
+	Kinds []string
+	// BatchSize is the number of keys read at once. default and maximum is 500.
+	BatchSize int
+	// Cursors resumes the migration from the cursor of each kind. see Progress.
+	Cursors map[string]string
+	// Progress is called after each batch is rewritten. save the cursor to resume the interrupted migration.
+	Progress func(kind string, cursor string, migrated int)
+}
+
+// MigrateRequestKeys rewrites entities stored with raw key names to derived key names by Config.KeyNameDeriver.
+// it returns the number of rewritten entities per kind.
+// entities derived by rotated or dropped keys are skipped because raw values are unknown.
+// each entity is moved in its own transaction, so the concurrent writes, e.g. invalidations, aren't overwritten.
+func (s *datastoreStorage) MigrateRequestKeys(ctx context.Context, opts *MigrateKeysOptions) (map[string]int, error) {
+	if s.keyNameDeriver == nil {
+		return nil, errKeyNameDeriverRequired
+	}
+	if opts == nil {
+		opts = &MigrateKeysOptions{}
+	}
+	kinds := opts.Kinds
+	if len(kinds) == 0 {
+		kinds = []string{
+			s.AuthorizeCodeKind,
+			s.IDSessionKind,
+			s.AccessTokenKind,
+			s.RefreshTokenKind,
+			s.PKCEKind,
+		}
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 || deleteBatchSize < batchSize {
+		batchSize = deleteBatchSize
+	}
+
+	acc, err := s.accessor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// migration runs in batches out of the transaction, it may write more entities than a transaction allows.
+	acc = acc.NoTx()
+
+	counts := make(map[string]int)
+	for _, kind := range kinds {
+		counts[kind] = 0
+
+		cursor := opts.Cursors[kind]
+		for {
+			q := acc.NewQuery(kind).KeysOnly().Limit(batchSize)
+			if cursor != "" {
+				c, err := acc.DecodeCursor(cursor)
+				if err != nil {
+					return counts, err
+				}
+				q = q.Start(c)
+			}
+
+			var keys []datastore.Key
+			fetched := 0
+			it := acc.Run(q)
+			for {
+				key, err := it.Next(nil)
+				if err == iterator.Done {
+					break
+				} else if err != nil {
+					return counts, err
+				}
+				fetched++
+
+				if !s.keyNameDeriver.IsDerived(key.Name()) {
+					keys = append(keys, key)
+				}
+			}
+
+			for _, key := range keys {
+				migrated, err := s.migrateRequestKey(acc, kind, key)
+				if err != nil {
+					return counts, err
+				}
+				if migrated {
+					counts[kind]++
+				}
+			}
+
+			c, err := it.Cursor()
+			if err != nil {
+				return counts, err
+			}
+			cursor = c.String()
+			if opts.Progress != nil {
+				opts.Progress(kind, cursor, counts[kind])
+			}
+
+			if fetched < batchSize {
+				break
+			}
+		}
+	}
+
+	return counts, nil
+}
+
+// migrateRequestKey moves the entity of the raw key name to the derived key name in the transaction.
+// properties are copied as is to keep custom requester types.
+// it returns false if the entity is deleted or migrated by others after the query.
+func (s *datastoreStorage) migrateRequestKey(acc *dsAccessor, kind string, oldKey datastore.Key) (bool, error) {
+	newName := s.keyNameDeriver.DeriveKeyNames(kind, oldKey.Name())[0]
+	newKey := acc.NameKey(kind, newName, nil)
+
+	migrated := false
+	err := acc.RunInTransaction(func(tx datastore.Transaction) error {
+		migrated = false
+
+		var ps datastore.PropertyList
+		err := tx.Get(oldKey, &ps)
+		if xerrors.Is(err, datastore.ErrNoSuchEntity) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// the derived one is newer if it exists. the raw entity is deleted after the derived one is stored.
+		err = tx.Get(newKey, &datastore.PropertyList{})
+		if xerrors.Is(err, datastore.ErrNoSuchEntity) {
+			_, err = tx.Put(newKey, &ps)
+			if err != nil {
+				return err
+			}
+			migrated = true
+		} else if err != nil {
+			return err
+		}
+		err = tx.Delete(oldKey)
+		if err != nil {
+			return err
+		}
+
+		return s.migrateRequestGroupMember(acc, tx, kind, oldKey.Name(), newName, ps)
+	})
+	return migrated, err
+}
@@ -0,0 +1,436 @@
+// Package memdatastore provides in-memory go.mercari.io/datastore.Client implementation.
+// It is intended to test fdsstorage without Cloud Datastore emulator.
+// Only the subset that fdsstorage uses is supported, and unsupported queries are rejected instead of ignored.
+// Like Cloud Datastore, queries in a transaction must be ancestor queries.
+package memdatastore
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"go.mercari.io/datastore"
+	"golang.org/x/xerrors"
+)
+
+var _ datastore.Client = (*Client)(nil)
+
+// Client is in-memory datastore.Client.
+// All Client that made by Clone share the same entities.
+type Client struct {
+	store       *store
+	ctx         context.Context
+	middlewares []datastore.Middleware
+}
+
+type store struct {
+	sync.Mutex
+	entities map[string]*entry
+	lastID   int64
+	// version is increased at every mutation. it is used to detect conflicts of transactions.
+	version int64
+}
+
+type entry struct {
+	key        *keyImpl
+	properties []datastore.Property
+	version    int64
+}
+
+// New returns empty in-memory datastore.Client.
+func New() *Client {
+	return &Client{
+		store: &store{
+			entities: make(map[string]*entry),
+		},
+		ctx: context.Background(),
+	}
+}
+
+// Clone returns new Client which shares entities with c.
+func (c *Client) Clone() *Client {
+	return &Client{
+		store: c.store,
+		ctx:   c.ctx,
+	}
+}
+
+// Reset removes all entities.
+func (c *Client) Reset() {
+	c.store.Lock()
+	defer c.store.Unlock()
+
+	c.store.entities = make(map[string]*entry)
+}
+
+func (c *Client) Get(ctx context.Context, key datastore.Key, dst interface{}) error {
+	err := c.GetMulti(ctx, []datastore.Key{key}, []interface{}{dst})
+	if merr, ok := err.(datastore.MultiError); ok {
+		return merr[0]
+	}
+	return err
+}
+
+func (c *Client) GetMulti(ctx context.Context, keys []datastore.Key, dst interface{}) error {
+	c.store.Lock()
+	entries := make([]*entry, len(keys))
+	for idx, key := range keys {
+		entries[idx] = c.store.entities[toKeyImpl(key).String()]
+	}
+	c.store.Unlock()
+
+	return loadMulti(ctx, keys, entries, dst)
+}
+
+func (c *Client) Put(ctx context.Context, key datastore.Key, src interface{}) (datastore.Key, error) {
+	keys, err := c.PutMulti(ctx, []datastore.Key{key}, []interface{}{src})
+	if merr, ok := err.(datastore.MultiError); ok {
+		return nil, merr[0]
+	} else if err != nil {
+		return nil, err
+	}
+	return keys[0], nil
+}
+
+func (c *Client) PutMulti(ctx context.Context, keys []datastore.Key, src interface{}) ([]datastore.Key, error) {
+	entries, err := c.store.saveMulti(ctx, keys, src)
+	if err != nil {
+		return nil, err
+	}
+
+	c.store.Lock()
+	defer c.store.Unlock()
+
+	newKeys := make([]datastore.Key, len(entries))
+	for idx, e := range entries {
+		c.store.put(e)
+		newKeys[idx] = e.key
+	}
+	return newKeys, nil
+}
+
+func (c *Client) Delete(ctx context.Context, key datastore.Key) error {
+	return c.DeleteMulti(ctx, []datastore.Key{key})
+}
+
+func (c *Client) DeleteMulti(ctx context.Context, keys []datastore.Key) error {
+	c.store.Lock()
+	defer c.store.Unlock()
+
+	for _, key := range keys {
+		delete(c.store.entities, toKeyImpl(key).String())
+	}
+	return nil
+}
+
+func (c *Client) NewTransaction(ctx context.Context) (datastore.Transaction, error) {
+	return &transaction{
+		ctx:    ctx,
+		client: c,
+		reads:  make(map[string]int64),
+	}, nil
+}
+
+func (c *Client) RunInTransaction(ctx context.Context, f func(tx datastore.Transaction) error) (datastore.Commit, error) {
+	const retries = 3
+
+	for i := 0; i < retries; i++ {
+		tx, err := c.NewTransaction(ctx)
+		if err != nil {
+			return nil, err
+		}
+		err = f(tx)
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+		commit, err := tx.Commit()
+		if xerrors.Is(err, datastore.ErrConcurrentTransaction) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return commit, nil
+	}
+
+	return nil, datastore.ErrConcurrentTransaction
+}
+
+func (c *Client) Run(ctx context.Context, q datastore.Query) datastore.Iterator {
+	qImpl, ok := q.(*queryImpl)
+	if !ok {
+		return &iteratorImpl{err: errUnsupportedQuery}
+	}
+
+	c.store.Lock()
+	entries, start, err := c.store.query(qImpl)
+	c.store.Unlock()
+	if err == nil && qImpl.tx != nil {
+		err = qImpl.tx.recordReads(entries)
+	}
+
+	return &iteratorImpl{
+		ctx:      ctx,
+		entries:  entries,
+		keysOnly: qImpl.keysOnly,
+		offset:   start,
+		start:    qImpl.start,
+		byKey:    len(qImpl.orders) == 0,
+		err:      err,
+	}
+}
+
+func (c *Client) AllocateIDs(ctx context.Context, keys []datastore.Key) ([]datastore.Key, error) {
+	c.store.Lock()
+	defer c.store.Unlock()
+
+	newKeys := make([]datastore.Key, len(keys))
+	for idx, key := range keys {
+		k := *toKeyImpl(key)
+		c.store.lastID++
+		k.id = c.store.lastID
+		newKeys[idx] = &k
+	}
+	return newKeys, nil
+}
+
+func (c *Client) Count(ctx context.Context, q datastore.Query) (int, error) {
+	keys, err := c.GetAll(ctx, q.KeysOnly(), nil)
+	if err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+func (c *Client) GetAll(ctx context.Context, q datastore.Query, dst interface{}) ([]datastore.Key, error) {
+	qImpl, ok := q.(*queryImpl)
+	if !ok {
+		return nil, errUnsupportedQuery
+	}
+
+	c.store.Lock()
+	entries, _, err := c.store.query(qImpl)
+	c.store.Unlock()
+	if err == nil && qImpl.tx != nil {
+		err = qImpl.tx.recordReads(entries)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]datastore.Key, 0, len(entries))
+	for _, e := range entries {
+		keys = append(keys, e.key)
+	}
+	if qImpl.keysOnly || dst == nil {
+		return keys, nil
+	}
+
+	dv := reflect.ValueOf(dst)
+	if dv.Kind() != reflect.Ptr || dv.Elem().Kind() != reflect.Slice {
+		return nil, datastore.ErrInvalidEntityType
+	}
+	sv := dv.Elem()
+	elemType := sv.Type().Elem()
+	for _, e := range entries {
+		var v reflect.Value
+		if elemType.Kind() == reflect.Ptr {
+			v = reflect.New(elemType.Elem())
+		} else {
+			v = reflect.New(elemType)
+		}
+		err := loadEntry(ctx, v.Interface(), e)
+		if err != nil {
+			return nil, err
+		}
+		if elemType.Kind() == reflect.Ptr {
+			sv = reflect.Append(sv, v)
+		} else {
+			sv = reflect.Append(sv, v.Elem())
+		}
+	}
+	dv.Elem().Set(sv)
+
+	return keys, nil
+}
+
+func (c *Client) IncompleteKey(kind string, parent datastore.Key) datastore.Key {
+	return c.NameKey(kind, "", parent)
+}
+
+func (c *Client) NameKey(kind, name string, parent datastore.Key) datastore.Key {
+	k := &keyImpl{
+		kind:   kind,
+		name:   name,
+		parent: toKeyImpl(parent),
+	}
+	if k.parent != nil {
+		k.namespace = k.parent.namespace
+	}
+	return k
+}
+
+func (c *Client) IDKey(kind string, id int64, parent datastore.Key) datastore.Key {
+	k := &keyImpl{
+		kind:   kind,
+		id:     id,
+		parent: toKeyImpl(parent),
+	}
+	if k.parent != nil {
+		k.namespace = k.parent.namespace
+	}
+	return k
+}
+
+func (c *Client) NewQuery(kind string) datastore.Query {
+	return &queryImpl{
+		kind: kind,
+	}
+}
+
+func (c *Client) Close() error {
+	return nil
+}
+
+func (c *Client) DecodeKey(encoded string) (datastore.Key, error) {
+	return decodeKey(encoded)
+}
+
+func (c *Client) DecodeCursor(s string) (datastore.Cursor, error) {
+	return decodeCursor(s)
+}
+
+func (c *Client) Batch() *datastore.Batch {
+	return &datastore.Batch{Client: c}
+}
+
+// AppendMiddleware only records middleware. memdatastore doesn't invoke it.
+func (c *Client) AppendMiddleware(middleware datastore.Middleware) {
+	c.middlewares = append(c.middlewares, middleware)
+}
+
+func (c *Client) RemoveMiddleware(middleware datastore.Middleware) bool {
+	for idx, mw := range c.middlewares {
+		if mw == middleware {
+			c.middlewares = append(c.middlewares[:idx], c.middlewares[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) Context() context.Context {
+	return c.ctx
+}
+
+func (c *Client) SetContext(ctx context.Context) {
+	c.ctx = ctx
+}
+
+// saveMulti converts src to entries. incomplete keys are completed.
+func (s *store) saveMulti(ctx context.Context, keys []datastore.Key, src interface{}) ([]*entry, error) {
+	sv := reflect.ValueOf(src)
+	if sv.Kind() != reflect.Slice || sv.Len() != len(keys) {
+		return nil, datastore.ErrInvalidEntityType
+	}
+
+	entries := make([]*entry, len(keys))
+	var errs datastore.MultiError
+	for idx, key := range keys {
+		k := *toKeyImpl(key)
+		if maxKeyNameSize < len(k.name) {
+			if errs == nil {
+				errs = make(datastore.MultiError, len(keys))
+			}
+			errs[idx] = errKeyNameTooLong
+			continue
+		}
+		if k.Incomplete() {
+			s.Lock()
+			s.lastID++
+			k.id = s.lastID
+			s.Unlock()
+		}
+
+		v := sv.Index(idx)
+		if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface {
+			v = v.Addr()
+		}
+		ent, err := datastore.SaveEntity(ctx, &k, v.Interface())
+		if err != nil {
+			if errs == nil {
+				errs = make(datastore.MultiError, len(keys))
+			}
+			errs[idx] = err
+			continue
+		}
+		entries[idx] = &entry{
+			key:        &k,
+			properties: ent.Properties,
+		}
+	}
+	if errs != nil {
+		return nil, errs
+	}
+
+	return entries, nil
+}
+
+// put stores e. s must be locked.
+func (s *store) put(e *entry) {
+	s.version++
+	e.version = s.version
+	s.entities[e.key.String()] = e
+}
+
+func loadMulti(ctx context.Context, keys []datastore.Key, entries []*entry, dst interface{}) error {
+	dv := reflect.ValueOf(dst)
+	if dv.Kind() != reflect.Slice || dv.Len() != len(keys) {
+		return datastore.ErrInvalidEntityType
+	}
+
+	var errs datastore.MultiError
+	for idx, e := range entries {
+		var err error
+		if e == nil {
+			err = datastore.ErrNoSuchEntity
+		} else {
+			v := dv.Index(idx)
+			if v.Kind() == reflect.Interface {
+				v = v.Elem()
+			}
+			if v.Kind() == reflect.Ptr && v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			} else if v.Kind() != reflect.Ptr {
+				v = v.Addr()
+			}
+			err = loadEntry(ctx, v.Interface(), e)
+		}
+		if err != nil {
+			if errs == nil {
+				errs = make(datastore.MultiError, len(keys))
+			}
+			errs[idx] = err
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+func loadEntry(ctx context.Context, dst interface{}, e *entry) error {
+	ps := make([]datastore.Property, len(e.properties))
+	copy(ps, e.properties)
+	err := datastore.LoadEntity(ctx, dst, &datastore.Entity{
+		Key:        e.key,
+		Properties: ps,
+	})
+	if err != nil {
+		return err
+	}
+	if keyLoader, ok := dst.(datastore.KeyLoader); ok {
+		return keyLoader.LoadKey(ctx, e.key)
+	}
+	return nil
+}
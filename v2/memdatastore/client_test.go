@@ -0,0 +1,170 @@
+package memdatastore
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+type testEntity struct {
+	Name string
+}
+
+func TestClient_QueryRejectsUnsupported(t *testing.T) {
+	ctx := context.Background()
+	client := New()
+
+	parent := client.NameKey("Parent", "p", nil)
+	_, err := client.Put(ctx, client.NameKey("Child", "c", parent), &testEntity{Name: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := client.NewTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	cases := []struct {
+		name string
+		run  func() error
+		want error
+	}{
+		{
+			name: "ancestor query in transaction",
+			run: func() error {
+				var list []*testEntity
+				_, err := client.GetAll(ctx, client.NewQuery("Child").Ancestor(parent).Transaction(tx), &list)
+				if err == nil && len(list) != 1 {
+					t.Errorf("unexpected result: %d", len(list))
+				}
+				return err
+			},
+		},
+		{
+			name: "non-ancestor query in transaction",
+			run: func() error {
+				var list []*testEntity
+				_, err := client.GetAll(ctx, client.NewQuery("Child").Transaction(tx), &list)
+				return err
+			},
+			want: errNonAncestorQueryInTx,
+		},
+		{
+			name: "projection",
+			run: func() error {
+				var list []*testEntity
+				_, err := client.GetAll(ctx, client.NewQuery("Child").Project("Name"), &list)
+				return err
+			},
+			want: errUnsupportedProjection,
+		},
+		{
+			name: "distinct",
+			run: func() error {
+				_, err := client.Count(ctx, client.NewQuery("Child").Distinct())
+				return err
+			},
+			want: errUnsupportedProjection,
+		},
+		{
+			name: "distinct on",
+			run: func() error {
+				iter := client.Run(ctx, client.NewQuery("Child").DistinctOn("Name"))
+				_, err := iter.Next(&testEntity{})
+				return err
+			},
+			want: errUnsupportedProjection,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.run()
+			if err != tc.want {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestClient_CursorResumesAfterKey(t *testing.T) {
+	ctx := context.Background()
+	client := New()
+
+	for _, name := range []string{"a", "b", "c"} {
+		_, err := client.Put(ctx, client.NameKey("Entity", name, nil), &testEntity{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it := client.Run(ctx, client.NewQuery("Entity").Limit(1))
+	key, err := it.Next(&testEntity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Name() != "a" {
+		t.Fatalf("unexpected key: %s", key.Name())
+	}
+	c, err := it.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the offset would skip "b" after "a" is deleted.
+	err = client.Delete(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = client.DecodeCursor(c.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []*testEntity
+	_, err = client.GetAll(ctx, client.NewQuery("Entity").Start(c), &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "b" || list[1].Name != "c" {
+		t.Fatalf("unexpected result: %+v", list)
+	}
+}
+
+func TestClient_TransactionMutationLimit(t *testing.T) {
+	ctx := context.Background()
+	client := New()
+
+	for _, size := range []int{maxTxMutations, maxTxMutations + 1} {
+		tx, err := client.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < size; i++ {
+			_, err := tx.Put(client.IDKey("Entity", int64(i+1), nil), &testEntity{})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = tx.Commit()
+		if size <= maxTxMutations && err != nil {
+			t.Errorf("%d: %v", size, err)
+		} else if maxTxMutations < size && err != errTooManyMutations {
+			t.Errorf("%d: errTooManyMutations is expected, but: %v", size, err)
+		}
+	}
+}
+
+func TestClient_KeyNameLimit(t *testing.T) {
+	ctx := context.Background()
+	client := New()
+
+	for _, size := range []int{maxKeyNameSize, maxKeyNameSize + 1} {
+		_, err := client.Put(ctx, client.NameKey("Entity", strings.Repeat("a", size), nil), &testEntity{})
+		if size <= maxKeyNameSize && err != nil {
+			t.Errorf("%d: %v", size, err)
+		} else if maxKeyNameSize < size && err != errKeyNameTooLong {
+			t.Errorf("%d: errKeyNameTooLong is expected, but: %v", size, err)
+		}
+	}
+}
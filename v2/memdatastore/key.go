@@ -0,0 +1,201 @@
+package memdatastore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mercari.io/datastore"
+)
+
+var _ datastore.Key = (*keyImpl)(nil)
+
+var errKeyNameTooLong = errors.New("memdatastore: key name is too long")
+
+// maxKeyNameSize is the limit of key names in bytes of Cloud Datastore.
+const maxKeyNameSize = 1500
+
+type keyImpl struct {
+	kind      string
+	id        int64
+	name      string
+	parent    *keyImpl
+	namespace string
+}
+
+type keyJSON struct {
+	Namespace string        `json:"namespace,omitempty"`
+	Path      []keyPathJSON `json:"path"`
+}
+
+type keyPathJSON struct {
+	Kind string `json:"kind"`
+	ID   int64  `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+func toKeyImpl(key datastore.Key) *keyImpl {
+	if key == nil {
+		return nil
+	}
+	if k, ok := key.(*keyImpl); ok {
+		return k
+	}
+	return &keyImpl{
+		kind:      key.Kind(),
+		id:        key.ID(),
+		name:      key.Name(),
+		parent:    toKeyImpl(key.ParentKey()),
+		namespace: key.Namespace(),
+	}
+}
+
+func (k *keyImpl) Kind() string {
+	return k.kind
+}
+
+func (k *keyImpl) ID() int64 {
+	return k.id
+}
+
+func (k *keyImpl) Name() string {
+	return k.name
+}
+
+func (k *keyImpl) ParentKey() datastore.Key {
+	if k.parent == nil {
+		return nil
+	}
+	return k.parent
+}
+
+func (k *keyImpl) Namespace() string {
+	return k.namespace
+}
+
+func (k *keyImpl) SetNamespace(namespace string) {
+	k.namespace = namespace
+}
+
+func (k *keyImpl) String() string {
+	if k == nil {
+		return ""
+	}
+	var b strings.Builder
+	if k.namespace != "" {
+		b.WriteString(strconv.Quote(k.namespace))
+		b.WriteString(":")
+	}
+	for _, p := range k.path() {
+		b.WriteString("/")
+		b.WriteString(p.kind)
+		b.WriteString(",")
+		if p.name != "" {
+			b.WriteString(strconv.Quote(p.name))
+		} else {
+			b.WriteString(strconv.FormatInt(p.id, 10))
+		}
+	}
+	return b.String()
+}
+
+// path returns keys from root to k.
+func (k *keyImpl) path() []*keyImpl {
+	var path []*keyImpl
+	for cur := k; cur != nil; cur = cur.parent {
+		path = append([]*keyImpl{cur}, path...)
+	}
+	return path
+}
+
+func (k *keyImpl) GobEncode() ([]byte, error) {
+	return k.MarshalJSON()
+}
+
+func (k *keyImpl) GobDecode(buf []byte) error {
+	return k.UnmarshalJSON(buf)
+}
+
+func (k *keyImpl) MarshalJSON() ([]byte, error) {
+	v := &keyJSON{
+		Namespace: k.namespace,
+	}
+	for _, p := range k.path() {
+		v.Path = append(v.Path, keyPathJSON{
+			Kind: p.kind,
+			ID:   p.id,
+			Name: p.name,
+		})
+	}
+	return json.Marshal(v)
+}
+
+func (k *keyImpl) UnmarshalJSON(buf []byte) error {
+	v := &keyJSON{}
+	err := json.Unmarshal(buf, v)
+	if err != nil {
+		return err
+	}
+	if len(v.Path) == 0 {
+		return datastore.ErrInvalidKey
+	}
+
+	var parent *keyImpl
+	for _, p := range v.Path {
+		parent = &keyImpl{
+			kind:      p.Kind,
+			id:        p.ID,
+			name:      p.Name,
+			parent:    parent,
+			namespace: v.Namespace,
+		}
+	}
+	*k = *parent
+	return nil
+}
+
+func (k *keyImpl) Encode() string {
+	b, err := k.MarshalJSON()
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (k *keyImpl) Equal(o datastore.Key) bool {
+	if o == nil {
+		return false
+	}
+	return k.String() == toKeyImpl(o).String()
+}
+
+func (k *keyImpl) Incomplete() bool {
+	return k.name == "" && k.id == 0
+}
+
+// hasAncestor reports whether ancestor is k itself or one of k's parents.
+func (k *keyImpl) hasAncestor(ancestor *keyImpl) bool {
+	s := ancestor.String()
+	for cur := k; cur != nil; cur = cur.parent {
+		if cur.String() == s {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeKey(encoded string) (*keyImpl, error) {
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("memdatastore: invalid encoded key: %v", err)
+	}
+	k := &keyImpl{}
+	err = k.UnmarshalJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
@@ -0,0 +1,543 @@
+package memdatastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mercari.io/datastore"
+	"google.golang.org/api/iterator"
+)
+
+var _ datastore.Query = (*queryImpl)(nil)
+var _ datastore.Iterator = (*iteratorImpl)(nil)
+var _ datastore.Cursor = cursor{}
+
+var errUnsupportedQuery = errors.New("memdatastore: query must be made by memdatastore.Client")
+var errUnsupportedTransaction = errors.New("memdatastore: transaction must be made by memdatastore.Client")
+var errUnsupportedProjection = errors.New("memdatastore: projection and distinct queries are not supported")
+var errNonAncestorQueryInTx = errors.New("memdatastore: only ancestor queries are allowed in a transaction")
+
+type queryImpl struct {
+	kind      string
+	ancestor  *keyImpl
+	namespace *string
+	tx        *transaction
+	filters   []*filter
+	orders    []*order
+	keysOnly  bool
+	limit     int
+	offset    int
+	start     *cursor
+	end       *cursor
+	err       error
+}
+
+type filter struct {
+	name  string
+	op    string
+	value interface{}
+}
+
+type order struct {
+	name string
+	desc bool
+}
+
+func (q *queryImpl) clone() *queryImpl {
+	q2 := *q
+	q2.filters = append([]*filter(nil), q.filters...)
+	q2.orders = append([]*order(nil), q.orders...)
+	return &q2
+}
+
+func (q *queryImpl) Ancestor(ancestor datastore.Key) datastore.Query {
+	q = q.clone()
+	q.ancestor = toKeyImpl(ancestor)
+	return q
+}
+
+func (q *queryImpl) EventualConsistency() datastore.Query {
+	return q.clone()
+}
+
+func (q *queryImpl) Namespace(ns string) datastore.Query {
+	q = q.clone()
+	q.namespace = &ns
+	return q
+}
+
+// Transaction runs the query in the transaction. it must be an ancestor query.
+func (q *queryImpl) Transaction(t datastore.Transaction) datastore.Query {
+	q = q.clone()
+	tx, ok := t.(*transaction)
+	if !ok {
+		q.err = errUnsupportedTransaction
+		return q
+	}
+	q.tx = tx
+	return q
+}
+
+func (q *queryImpl) Filter(filterStr string, value interface{}) datastore.Query {
+	q = q.clone()
+	filterStr = strings.TrimSpace(filterStr)
+	idx := strings.LastIndex(filterStr, " ")
+	if idx == -1 {
+		q.err = fmt.Errorf("memdatastore: invalid filter: %s", filterStr)
+		return q
+	}
+	name := strings.TrimSpace(filterStr[:idx])
+	op := filterStr[idx+1:]
+	switch op {
+	case "=", "<", "<=", ">", ">=":
+	default:
+		q.err = fmt.Errorf("memdatastore: unsupported operator: %s", op)
+		return q
+	}
+	q.filters = append(q.filters, &filter{
+		name:  name,
+		op:    op,
+		value: normalizeValue(value),
+	})
+	return q
+}
+
+func (q *queryImpl) Order(fieldName string) datastore.Query {
+	q = q.clone()
+	fieldName = strings.TrimSpace(fieldName)
+	o := &order{name: fieldName}
+	if strings.HasPrefix(fieldName, "-") {
+		o.name = strings.TrimSpace(fieldName[1:])
+		o.desc = true
+	}
+	q.orders = append(q.orders, o)
+	return q
+}
+
+// Project is not supported. the query fails on run.
+func (q *queryImpl) Project(fieldNames ...string) datastore.Query {
+	q = q.clone()
+	q.err = errUnsupportedProjection
+	return q
+}
+
+// Distinct is not supported. the query fails on run.
+func (q *queryImpl) Distinct() datastore.Query {
+	q = q.clone()
+	q.err = errUnsupportedProjection
+	return q
+}
+
+// DistinctOn is not supported. the query fails on run.
+func (q *queryImpl) DistinctOn(fieldNames ...string) datastore.Query {
+	q = q.clone()
+	q.err = errUnsupportedProjection
+	return q
+}
+
+func (q *queryImpl) KeysOnly() datastore.Query {
+	q = q.clone()
+	q.keysOnly = true
+	return q
+}
+
+func (q *queryImpl) Limit(limit int) datastore.Query {
+	q = q.clone()
+	q.limit = limit
+	return q
+}
+
+func (q *queryImpl) Offset(offset int) datastore.Query {
+	q = q.clone()
+	q.offset = offset
+	return q
+}
+
+func (q *queryImpl) Start(c datastore.Cursor) datastore.Query {
+	q = q.clone()
+	cur, err := toCursor(c)
+	if err != nil {
+		q.err = err
+		return q
+	}
+	q.start = &cur
+	return q
+}
+
+func (q *queryImpl) End(c datastore.Cursor) datastore.Query {
+	q = q.clone()
+	cur, err := toCursor(c)
+	if err != nil {
+		q.err = err
+		return q
+	}
+	q.end = &cur
+	return q
+}
+
+func (q *queryImpl) Dump() *datastore.QueryDump {
+	dump := &datastore.QueryDump{
+		Kind:     q.kind,
+		KeysOnly: q.keysOnly,
+		Limit:    q.limit,
+		Offset:   q.offset,
+	}
+	for _, f := range q.filters {
+		dump.Filter = append(dump.Filter, &datastore.QueryFilterCondition{
+			Filter: f.name + " " + f.op,
+			Value:  f.value,
+		})
+	}
+	return dump
+}
+
+// query returns matched entries and the offset of the first entry in all of the matched entries.
+// s must be locked.
+func (s *store) query(q *queryImpl) ([]*entry, int, error) {
+	if q.err != nil {
+		return nil, 0, q.err
+	}
+	if q.tx != nil && q.ancestor == nil {
+		return nil, 0, errNonAncestorQueryInTx
+	}
+
+	var namespace string
+	if q.namespace != nil {
+		namespace = *q.namespace
+	} else if q.ancestor != nil {
+		namespace = q.ancestor.namespace
+	}
+
+	var entries []*entry
+	for _, e := range s.entities {
+		if e.key.kind != q.kind || e.key.namespace != namespace {
+			continue
+		}
+		if q.ancestor != nil && !e.key.hasAncestor(q.ancestor) {
+			continue
+		}
+		if !matchFilters(e, q.filters) {
+			continue
+		}
+		if !hasOrderProperties(e, q.orders) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		for _, o := range q.orders {
+			c := compareValues(firstValue(entries[i], o.name), firstValue(entries[j], o.name))
+			if c == 0 {
+				continue
+			}
+			if o.desc {
+				return 0 < c
+			}
+			return c < 0
+		}
+		return entries[i].key.String() < entries[j].key.String()
+	})
+
+	start := q.offset
+	if q.start != nil {
+		start += q.start.position(entries)
+	}
+	end := len(entries)
+	if q.end != nil && q.end.position(entries) < end {
+		end = q.end.position(entries)
+	}
+	if 0 < q.limit && start+q.limit < end {
+		end = start + q.limit
+	}
+	if end < start {
+		start = end
+	}
+	if len(entries) < start {
+		return nil, len(entries), nil
+	}
+
+	return entries[start:end], start, nil
+}
+
+func matchFilters(e *entry, filters []*filter) bool {
+	for _, f := range filters {
+		var values []interface{}
+		if f.name == "__key__" {
+			values = []interface{}{e.key}
+		} else {
+			values = indexedValues(e, f.name)
+		}
+
+		matched := false
+		for _, v := range values {
+			c, ok := compare(v, f.value)
+			if !ok {
+				continue
+			}
+			switch f.op {
+			case "=":
+				matched = c == 0
+			case "<":
+				matched = c < 0
+			case "<=":
+				matched = c <= 0
+			case ">":
+				matched = 0 < c
+			case ">=":
+				matched = 0 <= c
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func hasOrderProperties(e *entry, orders []*order) bool {
+	for _, o := range orders {
+		if len(indexedValues(e, o.name)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// indexedValues returns values of the property. multiple values are flattened.
+func indexedValues(e *entry, name string) []interface{} {
+	var values []interface{}
+	for _, p := range e.properties {
+		if p.Name != name || p.NoIndex {
+			continue
+		}
+		if vs, ok := p.Value.([]interface{}); ok {
+			for _, v := range vs {
+				values = append(values, normalizeValue(v))
+			}
+		} else {
+			values = append(values, normalizeValue(p.Value))
+		}
+	}
+	return values
+}
+
+func firstValue(e *entry, name string) interface{} {
+	values := indexedValues(e, name)
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+func normalizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case datastore.Key:
+		return toKeyImpl(v)
+	default:
+		return v
+	}
+}
+
+// compare compares same type values. ok is false if the types are different.
+func compare(a, b interface{}) (c int, ok bool) {
+	switch a := a.(type) {
+	case nil:
+		return 0, b == nil
+	case int64:
+		b, ok := b.(int64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case a < b:
+			return -1, true
+		case b < a:
+			return 1, true
+		}
+		return 0, true
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case a < b:
+			return -1, true
+		case b < a:
+			return 1, true
+		}
+		return 0, true
+	case bool:
+		b, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case a == b:
+			return 0, true
+		case !a:
+			return -1, true
+		}
+		return 1, true
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a, b), true
+	case []byte:
+		b, ok := b.([]byte)
+		if !ok {
+			return 0, false
+		}
+		return bytes.Compare(a, b), true
+	case time.Time:
+		b, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case a.Before(b):
+			return -1, true
+		case a.After(b):
+			return 1, true
+		}
+		return 0, true
+	case *keyImpl:
+		b, ok := b.(*keyImpl)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a.String(), b.String()), true
+	}
+	return 0, false
+}
+
+// compareValues compares values for sorting. values of different types are ordered by its type name.
+func compareValues(a, b interface{}) int {
+	if c, ok := compare(a, b); ok {
+		return c
+	}
+	return strings.Compare(fmt.Sprintf("%T", a), fmt.Sprintf("%T", b))
+}
+
+// cursor is the position in the query result.
+// on queries ordered by key, it points after the last returned key like Cloud Datastore,
+// so it doesn't skip nor repeat entities when others are added or deleted. otherwise it is the offset.
+type cursor struct {
+	offset int
+	after  string
+}
+
+func (c cursor) String() string {
+	s := "o:" + strconv.Itoa(c.offset)
+	if c.after != "" {
+		s = "k:" + c.after
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// position returns the index of entries where the query starts or ends.
+func (c cursor) position(entries []*entry) int {
+	if c.after == "" {
+		return c.offset
+	}
+	return sort.Search(len(entries), func(i int) bool {
+		return c.after < entries[i].key.String()
+	})
+}
+
+func decodeCursor(s string) (cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, fmt.Errorf("memdatastore: invalid cursor: %v", err)
+	}
+	v := string(b)
+	switch {
+	case strings.HasPrefix(v, "k:") && len(v) != 2:
+		return cursor{after: v[2:]}, nil
+	case strings.HasPrefix(v, "o:"):
+		offset, err := strconv.Atoi(v[2:])
+		if err != nil {
+			return cursor{}, fmt.Errorf("memdatastore: invalid cursor: %v", err)
+		}
+		return cursor{offset: offset}, nil
+	default:
+		return cursor{}, fmt.Errorf("memdatastore: invalid cursor: %q", v)
+	}
+}
+
+func toCursor(c datastore.Cursor) (cursor, error) {
+	if cur, ok := c.(cursor); ok {
+		return cur, nil
+	}
+	return decodeCursor(c.String())
+}
+
+type iteratorImpl struct {
+	ctx      context.Context
+	entries  []*entry
+	keysOnly bool
+	offset   int
+	// start is the cursor of the query, and byKey is true if the query is ordered by key.
+	start *cursor
+	byKey bool
+	next  int
+	err   error
+}
+
+func (it *iteratorImpl) Next(dst interface{}) (datastore.Key, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if len(it.entries) <= it.next {
+		return nil, iterator.Done
+	}
+
+	e := it.entries[it.next]
+	it.next++
+	if !it.keysOnly && dst != nil {
+		err := loadEntry(it.ctx, dst, e)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e.key, nil
+}
+
+func (it *iteratorImpl) Cursor() (datastore.Cursor, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if !it.byKey {
+		return cursor{offset: it.offset + it.next}, nil
+	}
+	if it.next != 0 {
+		return cursor{after: it.entries[it.next-1].key.String()}, nil
+	}
+	if it.start != nil && it.start.after != "" {
+		return *it.start, nil
+	}
+	return cursor{offset: it.offset}, nil
+}
@@ -0,0 +1,209 @@
+package memdatastore
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"go.mercari.io/datastore"
+)
+
+var _ datastore.Transaction = (*transaction)(nil)
+var _ datastore.Commit = (*commit)(nil)
+var _ datastore.PendingKey = (*pendingKey)(nil)
+
+var errFinishedTransaction = errors.New("memdatastore: transaction has already been committed or rolled back")
+var errTooManyMutations = errors.New("memdatastore: too many mutations in a transaction")
+
+// maxTxMutations is the limit of mutations in a commit of Cloud Datastore.
+const maxTxMutations = 500
+
+// transaction buffers mutations until Commit.
+// like Cloud Datastore, reads don't see the mutations of the same transaction,
+// and Commit fails with datastore.ErrConcurrentTransaction if the read entities are modified by others.
+type transaction struct {
+	sync.Mutex
+	ctx      context.Context
+	client   *Client
+	reads    map[string]int64
+	mutation []*mutation
+	finished bool
+}
+
+type mutation struct {
+	key     *keyImpl
+	entry   *entry
+	pending *pendingKey
+}
+
+type pendingKey struct {
+	ctx context.Context
+	key *keyImpl
+}
+
+type commit struct{}
+
+func (tx *transaction) Get(key datastore.Key, dst interface{}) error {
+	err := tx.GetMulti([]datastore.Key{key}, []interface{}{dst})
+	if merr, ok := err.(datastore.MultiError); ok {
+		return merr[0]
+	}
+	return err
+}
+
+func (tx *transaction) GetMulti(keys []datastore.Key, dst interface{}) error {
+	tx.Lock()
+	defer tx.Unlock()
+	if tx.finished {
+		return errFinishedTransaction
+	}
+
+	store := tx.client.store
+	store.Lock()
+	entries := make([]*entry, len(keys))
+	for idx, key := range keys {
+		keyStr := toKeyImpl(key).String()
+		e := store.entities[keyStr]
+		entries[idx] = e
+		if e != nil {
+			tx.reads[keyStr] = e.version
+		} else {
+			tx.reads[keyStr] = 0
+		}
+	}
+	store.Unlock()
+
+	return loadMulti(tx.ctx, keys, entries, dst)
+}
+
+func (tx *transaction) Put(key datastore.Key, src interface{}) (datastore.PendingKey, error) {
+	pKeys, err := tx.PutMulti([]datastore.Key{key}, []interface{}{src})
+	if merr, ok := err.(datastore.MultiError); ok {
+		return nil, merr[0]
+	} else if err != nil {
+		return nil, err
+	}
+	return pKeys[0], nil
+}
+
+func (tx *transaction) PutMulti(keys []datastore.Key, src interface{}) ([]datastore.PendingKey, error) {
+	tx.Lock()
+	defer tx.Unlock()
+	if tx.finished {
+		return nil, errFinishedTransaction
+	}
+
+	entries, err := tx.client.store.saveMulti(tx.ctx, keys, src)
+	if err != nil {
+		return nil, err
+	}
+
+	pKeys := make([]datastore.PendingKey, len(entries))
+	for idx, e := range entries {
+		p := &pendingKey{ctx: tx.ctx, key: e.key}
+		tx.mutation = append(tx.mutation, &mutation{
+			key:     e.key,
+			entry:   e,
+			pending: p,
+		})
+		pKeys[idx] = p
+	}
+	return pKeys, nil
+}
+
+func (tx *transaction) Delete(key datastore.Key) error {
+	return tx.DeleteMulti([]datastore.Key{key})
+}
+
+func (tx *transaction) DeleteMulti(keys []datastore.Key) error {
+	tx.Lock()
+	defer tx.Unlock()
+	if tx.finished {
+		return errFinishedTransaction
+	}
+
+	for _, key := range keys {
+		tx.mutation = append(tx.mutation, &mutation{
+			key: toKeyImpl(key),
+		})
+	}
+	return nil
+}
+
+func (tx *transaction) Commit() (datastore.Commit, error) {
+	tx.Lock()
+	defer tx.Unlock()
+	if tx.finished {
+		return nil, errFinishedTransaction
+	}
+	tx.finished = true
+	if maxTxMutations < len(tx.mutation) {
+		return nil, errTooManyMutations
+	}
+
+	store := tx.client.store
+	store.Lock()
+	defer store.Unlock()
+
+	for keyStr, version := range tx.reads {
+		var current int64
+		if e, ok := store.entities[keyStr]; ok {
+			current = e.version
+		}
+		if current != version {
+			return nil, datastore.ErrConcurrentTransaction
+		}
+	}
+
+	for _, m := range tx.mutation {
+		if m.entry != nil {
+			store.put(m.entry)
+		} else {
+			delete(store.entities, m.key.String())
+		}
+	}
+
+	return &commit{}, nil
+}
+
+func (tx *transaction) Rollback() error {
+	tx.Lock()
+	defer tx.Unlock()
+	if tx.finished {
+		return errFinishedTransaction
+	}
+	tx.finished = true
+	tx.mutation = nil
+
+	return nil
+}
+
+// recordReads records versions of entries read by the ancestor query to detect conflicts on Commit.
+func (tx *transaction) recordReads(entries []*entry) error {
+	tx.Lock()
+	defer tx.Unlock()
+	if tx.finished {
+		return errFinishedTransaction
+	}
+
+	for _, e := range entries {
+		tx.reads[e.key.String()] = e.version
+	}
+	return nil
+}
+
+func (tx *transaction) Batch() *datastore.TransactionBatch {
+	return &datastore.TransactionBatch{Transaction: tx}
+}
+
+func (c *commit) Key(p datastore.PendingKey) datastore.Key {
+	pk, ok := p.(*pendingKey)
+	if !ok {
+		return nil
+	}
+	return pk.key
+}
+
+func (p *pendingKey) StoredContext() context.Context {
+	return p.ctx
+}
@@ -0,0 +1,167 @@
+package fdsstorage
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var _ PasswordHasher = (*BCryptHasher)(nil)
+var _ PasswordHasher = (*Argon2Hasher)(nil)
+
+// PasswordHasher hashes passwords of users.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// Compare returns ErrPasswordMismatch if the password doesn't match the hash.
+	// it must return another error for the hash which isn't made by it,
+	// then the hash is compared by the built-in hasher that made it.
+	Compare(hash string, password string) error
+}
+
+// BCryptHasher hashes passwords by bcrypt. it is compatible with the hash of example/domains.User.
+type BCryptHasher struct {
+	// Cost of bcrypt. default is bcrypt.DefaultCost.
+	Cost int
+}
+
+// Hash returns bcrypt hash of the password.
+func (h *BCryptHasher) Hash(password string) (string, error) {
+	cost := h.Cost
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Compare compares bcrypt hash and the password.
+func (h *BCryptHasher) Compare(hash string, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrPasswordMismatch
+	}
+	return err
+}
+
+// Argon2Hasher hashes passwords by argon2id.
+// the hash is encoded as "$argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>".
+type Argon2Hasher struct {
+	// Time is the number of passes. default is 1.
+	Time uint32
+	// Memory is the memory size in KiB. default is 64 MiB, maximum is 1 GiB.
+	Memory uint32
+	// Threads is the degree of parallelism. default is 4.
+	Threads uint8
+}
+
+const argon2KeyLen = 32
+const argon2SaltLen = 16
+
+// argon2MaxMemory limits the memory size taken from the hash, the stored hash must not exhaust the memory.
+const argon2MaxMemory = 1024 * 1024
+
+// Hash returns argon2id hash of the password.
+func (h *Argon2Hasher) Hash(password string) (string, error) {
+	t, m, p := h.Time, h.Memory, h.Threads
+	if t == 0 {
+		t = 1
+	}
+	if m == 0 {
+		m = 64 * 1024
+	}
+	if p == 0 {
+		p = 4
+	}
+	if argon2MaxMemory < m {
+		return "", errArgon2MemoryTooLarge
+	}
+
+	salt := make([]byte, argon2SaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, t, m, p, argon2KeyLen)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, m, t, p,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Compare compares argon2id hash and the password. parameters are taken from the hash.
+func (h *Argon2Hasher) Compare(hash string, password string) error {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return errInvalidPasswordHash
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return errInvalidPasswordHash
+	}
+	if version != argon2.Version {
+		return errInvalidPasswordHash
+	}
+	var t, m uint32
+	var p uint8
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &m, &t, &p)
+	if err != nil {
+		return errInvalidPasswordHash
+	}
+	// argon2.IDKey panics with zero threads, and the zero time or key matches any password.
+	if t == 0 || p == 0 || argon2MaxMemory < m {
+		return errInvalidPasswordHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return errInvalidPasswordHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return errInvalidPasswordHash
+	}
+
+	inputKey := argon2.IDKey([]byte(password), salt, t, m, p, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, inputKey) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+// comparePasswordHash compares the hash and the password by UserStoreOptions.Hasher.
+// the hash which isn't made by it is compared by the built-in hasher that made the hash,
+// it allows to change the hasher without rehashing all passwords.
+func (s *datastoreStorage) comparePasswordHash(hash string, password string) error {
+	err := s.userStoreOptions.Hasher.Compare(hash, password)
+	if err == nil || err == ErrPasswordMismatch {
+		return err
+	}
+
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return (&Argon2Hasher{}).Compare(hash, password)
+	case strings.HasPrefix(hash, "$2"):
+		return (&BCryptHasher{}).Compare(hash, password)
+	}
+	return err
+}
+
+// dummyPasswordHash returns the hash which is compared for unknown users to take as long as known users.
+// it is made by UserStoreOptions.Hasher on the first use.
+func (s *datastoreStorage) dummyPasswordHash() string {
+	s.dummyPasswordHashOnce.Do(func() {
+		s.dummyPasswordHashValue, _ = s.userStoreOptions.Hasher.Hash("dummy password")
+	})
+	return s.dummyPasswordHashValue
+}
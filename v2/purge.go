@@ -0,0 +1,103 @@
+package fdsstorage
+
+import (
+	"context"
+	"time"
+
+	"go.mercari.io/datastore"
+	"google.golang.org/api/iterator"
+)
+
+const defaultPurgeBatchSize = deleteBatchSize
+
+// PurgeOptions provides some settings for PurgeExpired.
+type PurgeOptions struct {
+	// Kinds to sweep. default is all request kinds (authorize code, OpenID Connect session, access token, refresh token and PKCE)
+	// and the request group members of RequestAncestorKeyLayout, the counters of RateLimiter and the cache of JSON Web Key Sets.
+	Kinds []string
+	// BatchSize is the number of entities deleted at once. default and maximum is 500.
+	BatchSize int
+}
+
+// PurgeExpired deletes entities whose ExpiresAt is before the given time.
+// It returns the number of deleted entities per kind.
+// entities without ExpiresAt (zero value) are never deleted.
+func (s *datastoreStorage) PurgeExpired(ctx context.Context, before time.Time, opts *PurgeOptions) (map[string]int, error) {
+	if opts == nil {
+		opts = &PurgeOptions{}
+	}
+	kinds := opts.Kinds
+	if len(kinds) == 0 {
+		kinds = []string{
+			s.AuthorizeCodeKind,
+			s.IDSessionKind,
+			s.AccessTokenKind,
+			s.RefreshTokenKind,
+			s.PKCEKind,
+			s.RequestGroupMemberKind,
+			s.RateLimitKind,
+			s.JWKSCacheKind,
+		}
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 || defaultPurgeBatchSize < batchSize {
+		batchSize = defaultPurgeBatchSize
+	}
+
+	acc, err := s.accessor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// purge runs in batches out of the transaction, it may delete more entities than a transaction allows.
+	acc = acc.NoTx()
+
+	counts := make(map[string]int)
+	for _, kind := range kinds {
+		counts[kind] = 0
+
+		// page by the cursor, deleted keys may be returned again by the eventually consistent query from the start.
+		var cursor datastore.Cursor
+		for {
+			// zero time.Time is stored as 0001-01-01, so lower bound excludes entities that never expire.
+			q := acc.NewQuery(kind).
+				Filter("ExpiresAt >", time.Unix(0, 0)).
+				Filter("ExpiresAt <", before).
+				KeysOnly().
+				Limit(batchSize)
+			if cursor != nil {
+				q = q.Start(cursor)
+			}
+
+			var keys []datastore.Key
+			it := acc.Run(q)
+			for {
+				key, err := it.Next(nil)
+				if err == iterator.Done {
+					break
+				} else if err != nil {
+					return counts, err
+				}
+				keys = append(keys, key)
+			}
+			if len(keys) == 0 {
+				break
+			}
+
+			err = acc.DeleteMulti(keys)
+			if err != nil {
+				return counts, err
+			}
+			counts[kind] += len(keys)
+
+			if len(keys) < batchSize {
+				break
+			}
+			cursor, err = it.Cursor()
+			if err != nil {
+				return counts, err
+			}
+		}
+	}
+
+	return counts, nil
+}
@@ -0,0 +1,280 @@
+package fdsstorage
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/ory/fosite"
+	"go.mercari.io/datastore"
+	"golang.org/x/xerrors"
+)
+
+// ErrRateLimited is returned while attempts exceed RateLimitPolicy.
+// Authenticate wraps it as fosite.ErrNotFound, so the password grant responds the same way as a wrong password.
+// ClientAuthHasher returns it as is, and fosite responds it as invalid_client.
+var ErrRateLimited = fosite.ErrRequestForbidden.WithHint("Too many attempts, please try again later.")
+
+// RateLimitPolicy limits attempts in the sliding window.
+type RateLimitPolicy struct {
+	// Limit is the maximum number of attempts in Window.
+	Limit int
+	// Window is the length of the sliding window.
+	Window time.Duration
+	// Lockout rejects all attempts for this duration after Limit is exceeded.
+	// zero means attempts are allowed again when old attempts leave the window.
+	Lockout time.Duration
+}
+
+// RateLimiterOptions provides settings of the rate limiter. nil policy disables the limit.
+type RateLimiterOptions struct {
+	// User limits failures of Authenticate by user name.
+	User *RateLimitPolicy
+	// Client limits failures reported by RecordClientAuthFailure by client ID.
+	// ClientAuthHasher rejects the client authentication while the client is limited.
+	Client *RateLimitPolicy
+	// IP limits both of above by the IP address set by WithClientIP.
+	IP *RateLimitPolicy
+	// Shards is the number of entities that counters of each key are spread on. default is 8.
+	Shards int
+}
+
+// rateLimitBuckets is the number of buckets in the sliding window.
+const rateLimitBuckets = 10
+
+const (
+	rateLimitScopeUser   = "user"
+	rateLimitScopeClient = "client"
+	rateLimitScopeIP     = "ip"
+)
+
+type contextClientIPKey struct{}
+
+// WithClientIP returns the context with the IP address of the requester, it is used by RateLimiterOptions.IP.
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, contextClientIPKey{}, ip)
+}
+
+func clientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(contextClientIPKey{}).(string)
+	return ip
+}
+
+// rateLimitShard counts attempts per bucket. buckets out of the window are dropped on update.
+// ExpiresAt is when all buckets leave the window or the lock is released, PurgeExpired deletes it after that.
+type rateLimitShard struct {
+	BucketStarts []int64   `datastore:",noindex"` // unix nano
+	Counts       []int64   `datastore:",noindex"`
+	LockedUntil  time.Time `datastore:",noindex"` // only on the lock entity
+	ExpiresAt    time.Time ``
+	UpdatedAt    time.Time `datastore:",noindex"`
+}
+
+func (shard *rateLimitShard) count(since time.Time) int64 {
+	var count int64
+	for idx, start := range shard.BucketStarts {
+		if since.UnixNano() < start {
+			count += shard.Counts[idx]
+		}
+	}
+	return count
+}
+
+func (shard *rateLimitShard) add(now time.Time, policy *RateLimitPolicy) {
+	bucketSize := policy.Window / rateLimitBuckets
+	if bucketSize <= 0 {
+		bucketSize = 1
+	}
+	bucketStart := now.Truncate(bucketSize).UnixNano()
+	since := now.Add(-policy.Window).UnixNano()
+
+	var starts, counts []int64
+	found := false
+	for idx, start := range shard.BucketStarts {
+		if start <= since {
+			continue
+		}
+		count := shard.Counts[idx]
+		if start == bucketStart {
+			count++
+			found = true
+		}
+		starts = append(starts, start)
+		counts = append(counts, count)
+	}
+	if !found {
+		starts = append(starts, bucketStart)
+		counts = append(counts, 1)
+	}
+	shard.BucketStarts = starts
+	shard.Counts = counts
+	shard.ExpiresAt = time.Unix(0, bucketStart).Add(policy.Window)
+	shard.UpdatedAt = now
+}
+
+// rateLimitPolicy returns the policy of the scope.
+func (s *datastoreStorage) rateLimitPolicy(scope string) *RateLimitPolicy {
+	if s.rateLimiter == nil {
+		return nil
+	}
+	switch scope {
+	case rateLimitScopeUser:
+		return s.rateLimiter.User
+	case rateLimitScopeClient:
+		return s.rateLimiter.Client
+	case rateLimitScopeIP:
+		return s.rateLimiter.IP
+	default:
+		return nil
+	}
+}
+
+func (s *datastoreStorage) rateLimitKeys(acc *dsAccessor, scope string, id string) (shardKeys []datastore.Key, lockKey datastore.Key) {
+	prefix := scope + ":" + id + ":"
+	shardKeys = make([]datastore.Key, s.rateLimiter.Shards)
+	for idx := range shardKeys {
+		shardKeys[idx] = acc.NameKey(s.RateLimitKind, prefix+strconv.Itoa(idx), nil)
+	}
+	return shardKeys, acc.NameKey(s.RateLimitKind, prefix+"lock", nil)
+}
+
+// checkRateLimit returns ErrRateLimited if attempts of the id exceed the policy of the scope.
+func (s *datastoreStorage) checkRateLimit(ctx context.Context, scope string, id string) error {
+	policy := s.rateLimitPolicy(scope)
+	if policy == nil || id == "" {
+		return nil
+	}
+
+	acc, err := s.accessor(ctx)
+	if err != nil {
+		return err
+	}
+	acc = acc.NoTx()
+
+	shardKeys, lockKey := s.rateLimitKeys(acc, scope, id)
+	keys := append(shardKeys, lockKey)
+	shards := make([]*rateLimitShard, len(keys))
+	for idx := range shards {
+		shards[idx] = &rateLimitShard{}
+	}
+	err = acc.GetMulti(keys, shards)
+	if merr, ok := err.(datastore.MultiError); ok {
+		for _, err := range merr {
+			if err != nil && !xerrors.Is(err, datastore.ErrNoSuchEntity) {
+				return err
+			}
+		}
+	} else if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if now.Before(shards[len(shards)-1].LockedUntil) {
+		return ErrRateLimited
+	}
+
+	var count int64
+	for _, shard := range shards[:len(shardKeys)] {
+		count += shard.count(now.Add(-policy.Window))
+	}
+	if count < int64(policy.Limit) {
+		return nil
+	}
+
+	if policy.Lockout > 0 {
+		lockedUntil := now.Add(policy.Lockout)
+		err = acc.Put(lockKey, &rateLimitShard{
+			LockedUntil: lockedUntil,
+			ExpiresAt:   lockedUntil,
+			UpdatedAt:   now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return ErrRateLimited
+}
+
+// recordRateLimit counts the attempt of the id on the random shard.
+func (s *datastoreStorage) recordRateLimit(ctx context.Context, scope string, id string) error {
+	policy := s.rateLimitPolicy(scope)
+	if policy == nil || id == "" {
+		return nil
+	}
+
+	acc, err := s.accessor(ctx)
+	if err != nil {
+		return err
+	}
+	// the counter must be stored even if the caller rolls back its transaction.
+	acc = acc.NoTx()
+
+	shardKeys, _ := s.rateLimitKeys(acc, scope, id)
+	key := shardKeys[rand.Intn(len(shardKeys))]
+	return acc.RunInTransaction(func(tx datastore.Transaction) error {
+		shard := &rateLimitShard{}
+		err := tx.Get(key, shard)
+		if err != nil && !xerrors.Is(err, datastore.ErrNoSuchEntity) {
+			return err
+		}
+
+		shard.add(time.Now(), policy)
+
+		_, err = tx.Put(key, shard)
+		return err
+	})
+}
+
+// authenticate runs authenticateUser with the rate limit of the user and IP.
+// ErrRateLimited is wrapped as fosite.ErrNotFound, otherwise fosite responds it as server_error.
+func (s *datastoreStorage) authenticate(ctx context.Context, name string, secret string) error {
+	ip := clientIPFromContext(ctx)
+	err := s.checkRateLimit(ctx, rateLimitScopeUser, name)
+	if err == ErrRateLimited {
+		return wrapNotFound(err)
+	} else if err != nil {
+		return err
+	}
+	err = s.checkRateLimit(ctx, rateLimitScopeIP, ip)
+	if err == ErrRateLimited {
+		return wrapNotFound(err)
+	} else if err != nil {
+		return err
+	}
+
+	authErr := s.authenticateUser(ctx, name, secret)
+	if authErr == nil {
+		return nil
+	}
+
+	err = s.recordRateLimit(ctx, rateLimitScopeUser, name)
+	if err != nil {
+		return err
+	}
+	err = s.recordRateLimit(ctx, rateLimitScopeIP, ip)
+	if err != nil {
+		return err
+	}
+	return authErr
+}
+
+// CheckClientAuthRateLimit returns ErrRateLimited while the client or the IP address set by WithClientIP is limited.
+// ClientAuthHasher calls it before comparing the secret.
+func (s *datastoreStorage) CheckClientAuthRateLimit(ctx context.Context, clientID string) error {
+	err := s.checkRateLimit(ctx, rateLimitScopeClient, clientID)
+	if err != nil {
+		return err
+	}
+	return s.checkRateLimit(ctx, rateLimitScopeIP, clientIPFromContext(ctx))
+}
+
+// RecordClientAuthFailure counts the failure of the client authentication.
+// ClientAuthHasher calls it when the secret doesn't match.
+func (s *datastoreStorage) RecordClientAuthFailure(ctx context.Context, clientID string) error {
+	err := s.recordRateLimit(ctx, rateLimitScopeClient, clientID)
+	if err != nil {
+		return err
+	}
+	return s.recordRateLimit(ctx, rateLimitScopeIP, clientIPFromContext(ctx))
+}
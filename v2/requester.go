@@ -2,11 +2,11 @@ package fdsstorage
 
 import (
 	"context"
-	"encoding/json"
 	"net/url"
 	"time"
 
 	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
 	"go.mercari.io/datastore"
 )
 
@@ -17,8 +17,12 @@ var _ fosite.AuthorizeRequester = (*DefaultRequester)(nil)
 var _ datastore.PropertyLoadSaver = (*DefaultRequester)(nil)
 
 var _ ActiveStateModifier = (*DefaultRequester)(nil)
+var _ ExpiresAtModifier = (*DefaultRequester)(nil)
 var _ ClientLoader = (*DefaultRequester)(nil)
 var _ SessionRestorer = (*DefaultRequester)(nil)
+var _ EncrypterSetter = (*DefaultRequester)(nil)
+var _ SessionCodecRegistrySetter = (*DefaultRequester)(nil)
+var _ SessionTypeGetter = (*DefaultRequester)(nil)
 
 // ActiveStateModifier provides an action to enable and disable for fosite.Requester.
 type ActiveStateModifier interface {
@@ -26,6 +30,13 @@ type ActiveStateModifier interface {
 	SetActive(active bool)
 }
 
+// ExpiresAtModifier provides an action to get and set expiration time for fosite.Requester.
+// zero value means the request never expires.
+type ExpiresAtModifier interface {
+	GetExpiresAt() time.Time
+	SetExpiresAt(expiresAt time.Time)
+}
+
 // ClientLoader provides an action to set Client or get ClientID for fosite.Requester.
 type ClientLoader interface {
 	GetClientID() string
@@ -48,8 +59,14 @@ type DefaultRequester struct {
 	GrantedScope      []string       ``
 	EncodedForm       string         `json:"-"`
 	Form              url.Values     `datastore:"-"`
-	SessionJSON       string         `json:"-"`
+	SessionJSON       string         `json:"-" datastore:",noindex"`
+	SessionKeyID      string         `json:"-"` // not empty if SessionJSON is encrypted
+	SessionType       string         `json:"-"` // tag of SessionCodecRegistry, empty means JSON
 	Session           fosite.Session `datastore:"-"`
+	Subject           string         `json:"-"`
+	Nonce             string         `json:"-"` // for OpenID Connect
+	AuthTime          time.Time      `json:"-"` // for OpenID Connect
+	ACR               string         `json:"-"` // for OpenID Connect
 	RequestedAudience []string       ``
 	GrantedAudience   []string       ``
 	// for fosite.AccessRequest
@@ -61,14 +78,23 @@ type DefaultRequester struct {
 	State                string   ``
 	HandledResponseTypes []string ``
 	// others...
-	Active    bool      ``
-	UpdatedAt time.Time ``
-	CreatedAt time.Time ``
+	Active        bool      ``
+	ExpiresAt     time.Time ``
+	SchemaVersion int       ``
+	UpdatedAt     time.Time ``
+	CreatedAt     time.Time ``
+
+	Encrypter     Encrypter             `json:"-" datastore:"-"`
+	SessionCodecs *SessionCodecRegistry `json:"-" datastore:"-"`
 }
 
 // Load loads all of the provided properties into *DefaultRequester.
 func (r *DefaultRequester) Load(ctx context.Context, ps []datastore.Property) error {
-	err := datastore.LoadStruct(ctx, r, ps)
+	ps, err := upgradeSchema(ctx, requesterSchemaUpgrades, ps)
+	if err != nil {
+		return err
+	}
+	err = datastore.LoadStruct(ctx, r, ps)
 	if err != nil {
 		return err
 	}
@@ -78,6 +104,14 @@ func (r *DefaultRequester) Load(ctx context.Context, ps []datastore.Property) er
 		return err
 	}
 
+	if r.SessionKeyID != "" && r.Encrypter != nil {
+		r.SessionJSON, err = decryptString(ctx, r.Encrypter, r.SessionKeyID, r.SessionJSON)
+		if err != nil {
+			return err
+		}
+		r.SessionKeyID = ""
+	}
+
 	return nil
 }
 
@@ -88,22 +122,45 @@ func (r *DefaultRequester) Save(ctx context.Context) ([]datastore.Property, erro
 	}
 	r.UpdatedAt = time.Now()
 
+	// ClientID is kept as is if Client isn't loaded, e.g. on migration.
 	if r.Client != nil {
 		r.ClientID = r.Client.GetID()
-	} else {
-		r.ClientID = ""
 	}
+	r.SchemaVersion = requesterSchemaVersion
 
 	if r.Session != nil {
-		b, err := json.Marshal(r.Session)
+		var err error
+		r.SessionType, r.SessionJSON, err = r.SessionCodecs.Encode(r.Session)
 		if err != nil {
 			return nil, err
 		}
-		r.SessionJSON = string(b)
+		r.SessionKeyID = ""
+		r.Subject = r.Session.GetSubject()
+
+		if session, ok := r.Session.(openid.Session); ok && session.IDTokenClaims() != nil {
+			claims := session.IDTokenClaims()
+			r.Nonce = claims.Nonce
+			r.AuthTime = claims.AuthTime
+			r.ACR = claims.AuthenticationContextClassReference
+		}
+	}
+	if r.Nonce == "" {
+		r.Nonce = r.Form.Get("nonce")
 	}
 
 	r.EncodedForm = r.Form.Encode()
 
+	if r.Encrypter != nil && r.SessionKeyID == "" && r.SessionJSON != "" {
+		// r keeps plaintext, only saved properties are encrypted.
+		encrypted := *r
+		var err error
+		encrypted.SessionKeyID, encrypted.SessionJSON, err = encryptString(ctx, r.Encrypter, r.SessionJSON)
+		if err != nil {
+			return nil, err
+		}
+		return datastore.SaveStruct(ctx, &encrypted)
+	}
+
 	return datastore.SaveStruct(ctx, r)
 }
 
@@ -117,6 +174,31 @@ func (r *DefaultRequester) SetActive(active bool) {
 	r.Active = active
 }
 
+// GetExpiresAt returns the time this request expires.
+func (r *DefaultRequester) GetExpiresAt() time.Time {
+	return r.ExpiresAt
+}
+
+// SetExpiresAt to specified value.
+func (r *DefaultRequester) SetExpiresAt(expiresAt time.Time) {
+	r.ExpiresAt = expiresAt
+}
+
+// SetEncrypter to specified value.
+func (r *DefaultRequester) SetEncrypter(encrypter Encrypter) {
+	r.Encrypter = encrypter
+}
+
+// SetSessionCodecRegistry to specified value.
+func (r *DefaultRequester) SetSessionCodecRegistry(registry *SessionCodecRegistry) {
+	r.SessionCodecs = registry
+}
+
+// GetSessionType returns the type tag of the stored session.
+func (r *DefaultRequester) GetSessionType() string {
+	return r.SessionType
+}
+
 // GetClientID returns client ID.
 func (r *DefaultRequester) GetClientID() string {
 	return r.ClientID
@@ -130,7 +212,7 @@ func (r *DefaultRequester) SetClient(client fosite.Client) {
 // RestoreSession restores the passed Session to its original state and retains it as its own session.
 func (r *DefaultRequester) RestoreSession(ctx context.Context, session fosite.Session) error {
 	if r.SessionJSON != "" {
-		err := json.Unmarshal([]byte(r.SessionJSON), session)
+		err := r.SessionCodecs.Decode(r.SessionType, r.SessionJSON, session)
 		if err != nil {
 			return err
 		}
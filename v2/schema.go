@@ -0,0 +1,236 @@
+package fdsstorage
+
+import (
+	"context"
+
+	"github.com/ory/fosite"
+	"go.mercari.io/datastore"
+	"golang.org/x/xerrors"
+	"google.golang.org/api/iterator"
+)
+
+// SchemaUpgradeFunc upgrades properties of the entity to the next schema version.
+type SchemaUpgradeFunc func(ctx context.Context, ps []datastore.Property) ([]datastore.Property, error)
+
+// requesterSchemaVersion is the schema version of DefaultRequester written by Save.
+var requesterSchemaVersion = len(requesterSchemaUpgrades)
+
+// clientSchemaVersion is the schema version of DefaultClient written by Save.
+var clientSchemaVersion = len(clientSchemaUpgrades)
+
+// requesterSchemaUpgrades[v] upgrades DefaultRequester from version v to v+1.
+// append the function when the schema is changed incompatibly.
+var requesterSchemaUpgrades = []SchemaUpgradeFunc{
+	// v0 -> v1: v1 adds properties that are zero values on v0 entities.
+	upgradeSchemaVersionOnly,
+}
+
+// clientSchemaUpgrades[v] upgrades DefaultClient from version v to v+1.
+var clientSchemaUpgrades = []SchemaUpgradeFunc{
+	// v0 -> v1: v1 adds properties that are zero values on v0 entities.
+	upgradeSchemaVersionOnly,
+}
+
+func upgradeSchemaVersionOnly(ctx context.Context, ps []datastore.Property) ([]datastore.Property, error) {
+	return ps, nil
+}
+
+// schemaVersionOf returns SchemaVersion property. entities saved before versioning are version 0.
+func schemaVersionOf(ps []datastore.Property) int {
+	for _, p := range ps {
+		if p.Name != "SchemaVersion" {
+			continue
+		}
+		if v, ok := p.Value.(int64); ok {
+			return int(v)
+		}
+	}
+	return 0
+}
+
+// upgradeSchema runs upgrades from the version of properties to the latest one.
+func upgradeSchema(ctx context.Context, upgrades []SchemaUpgradeFunc, ps []datastore.Property) ([]datastore.Property, error) {
+	for version := schemaVersionOf(ps); version < len(upgrades); version++ {
+		var err error
+		ps, err = upgrades[version](ctx, ps)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+// MigrateSchemaOptions provides some settings for MigrateSchema.
+type MigrateSchemaOptions struct {
+	// Kinds to migrate. default is client kind and all request kinds.
+	Kinds []string
+	// BatchSize is the number of entities which are read and written at once. default and maximum is 500.
+	BatchSize int
+	// Cursors resumes the migration from the cursor of each kind. see Progress.
+	Cursors map[string]string
+	// Progress is called after each batch is written. save the cursor to resume the interrupted migration.
+	Progress func(kind string, cursor string, migrated int)
+}
+
+// MigrateSchema rewrites entities of older schema versions to the latest version in batches, and returns the number of migrated entities per kind.
+// it runs out of the transaction of ctx because it may write more entities than a transaction allows.
+// each entity is read and rewritten in its own transaction, so the concurrent writes, e.g. invalidations, aren't overwritten.
+func (s *datastoreStorage) MigrateSchema(ctx context.Context, opts *MigrateSchemaOptions) (map[string]int, error) {
+	if opts == nil {
+		opts = &MigrateSchemaOptions{}
+	}
+	kinds := opts.Kinds
+	if len(kinds) == 0 {
+		kinds = []string{
+			s.ClientKind,
+			s.AuthorizeCodeKind,
+			s.IDSessionKind,
+			s.AccessTokenKind,
+			s.RefreshTokenKind,
+			s.PKCEKind,
+		}
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 || deleteBatchSize < batchSize {
+		batchSize = deleteBatchSize
+	}
+
+	acc, err := s.accessor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	acc = acc.NoTx()
+
+	counts := make(map[string]int)
+	for _, kind := range kinds {
+		counts[kind] = 0
+
+		latest := requesterSchemaVersion
+		if kind == s.ClientKind {
+			latest = clientSchemaVersion
+		}
+
+		cursor := opts.Cursors[kind]
+		for {
+			q := acc.NewQuery(kind).Limit(batchSize)
+			if cursor != "" {
+				c, err := acc.DecodeCursor(cursor)
+				if err != nil {
+					return counts, err
+				}
+				q = q.Start(c)
+			}
+
+			var keys []datastore.Key
+			fetched := 0
+			it := acc.Run(q)
+			for {
+				var ps datastore.PropertyList
+				key, err := it.Next(&ps)
+				if err == iterator.Done {
+					break
+				} else if err != nil {
+					return counts, err
+				}
+				fetched++
+
+				if latest <= schemaVersionOf(ps) {
+					continue
+				}
+				keys = append(keys, key)
+			}
+
+			for _, key := range keys {
+				migrated, err := s.migrateSchemaEntity(acc, kind, key, latest)
+				if err != nil {
+					return counts, err
+				}
+				if migrated {
+					counts[kind]++
+				}
+			}
+
+			c, err := it.Cursor()
+			if err != nil {
+				return counts, err
+			}
+			cursor = c.String()
+			if opts.Progress != nil {
+				opts.Progress(kind, cursor, counts[kind])
+			}
+
+			if fetched < batchSize {
+				break
+			}
+		}
+	}
+
+	return counts, nil
+}
+
+// migrateSchemaEntity rewrites the entity to the latest schema version in the transaction.
+// it returns false if the entity is deleted or migrated by others after the query.
+func (s *datastoreStorage) migrateSchemaEntity(acc *dsAccessor, kind string, key datastore.Key, latest int) (bool, error) {
+	migrated := false
+	err := acc.RunInTransaction(func(tx datastore.Transaction) error {
+		migrated = false
+
+		var ps datastore.PropertyList
+		err := tx.Get(key, &ps)
+		if xerrors.Is(err, datastore.ErrNoSuchEntity) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if latest <= schemaVersionOf(ps) {
+			return nil
+		}
+
+		entity, err := s.schemaEntityDst(kind)
+		if err != nil {
+			return err
+		}
+		if loader, ok := entity.(datastore.KeyLoader); ok {
+			err = loader.LoadKey(acc.ctx, key)
+			if err != nil {
+				return err
+			}
+		}
+		err = loadPropertyList(acc.ctx, entity, ps)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Put(key, entity)
+		if err != nil {
+			return err
+		}
+		migrated = true
+		return nil
+	})
+	return migrated, err
+}
+
+// schemaEntityDst returns the value to load and rewrite the entity of the kind.
+func (s *datastoreStorage) schemaEntityDst(kind string) (interface{}, error) {
+	if kind != s.ClientKind {
+		return s.requestEntityDst(s.newRequester())
+	}
+	return s.clientEntityDst()
+}
+
+// clientEntityDst returns the value to load and rewrite the entity of the client.
+func (s *datastoreStorage) clientEntityDst() (interface{}, error) {
+	switch v := s.newClientEntity().(type) {
+	case *fosite.DefaultClient, *fosite.DefaultOpenIDConnectClient:
+		return &DefaultClient{Encrypter: s.encrypter}, nil
+
+	case datastore.PropertyLoadSaver:
+		if setter, ok := v.(EncrypterSetter); ok {
+			setter.SetEncrypter(s.encrypter)
+		}
+		return v, nil
+
+	default:
+		return nil, errUnsupportedClientType
+	}
+}
@@ -0,0 +1,188 @@
+package fdsstorage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+)
+
+var _ SessionCodec = JSONSessionCodec{}
+var _ SessionCodec = GobSessionCodec{}
+var _ SessionCodec = ProtoSessionCodec{}
+
+// SessionCodec encodes and decodes fosite.Session to text which is stored in DefaultRequester.SessionJSON.
+type SessionCodec interface {
+	Encode(session fosite.Session) (string, error)
+	Decode(data string, session fosite.Session) error
+}
+
+// SessionCodecRegistrySetter provides an action to set SessionCodecRegistry for entities.
+type SessionCodecRegistrySetter interface {
+	SetSessionCodecRegistry(registry *SessionCodecRegistry)
+}
+
+// SessionTypeGetter provides an action to get the type tag of the stored session.
+type SessionTypeGetter interface {
+	GetSessionType() string
+}
+
+// JSONSessionCodec encodes session by encoding/json. it is used for unregistered session types.
+type JSONSessionCodec struct{}
+
+// Encode session to JSON.
+func (JSONSessionCodec) Encode(session fosite.Session) (string, error) {
+	b, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Decode JSON to session.
+func (JSONSessionCodec) Decode(data string, session fosite.Session) error {
+	return json.Unmarshal([]byte(data), session)
+}
+
+// GobSessionCodec encodes session by encoding/gob.
+// it supports interface fields, concrete types of them must be registered by gob.Register.
+type GobSessionCodec struct{}
+
+// Encode session to base64 encoded gob.
+func (GobSessionCodec) Encode(session fosite.Session) (string, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(session)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// Decode base64 encoded gob to session.
+func (GobSessionCodec) Decode(data string, session fosite.Session) error {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(session)
+}
+
+// ProtoSessionCodec encodes session which has Marshal() ([]byte, error) and Unmarshal([]byte) error methods
+// like gogo/protobuf messages.
+type ProtoSessionCodec struct{}
+
+type protoMarshaler interface {
+	Marshal() ([]byte, error)
+}
+
+type protoUnmarshaler interface {
+	Unmarshal(data []byte) error
+}
+
+// Encode session to base64 encoded binary.
+func (ProtoSessionCodec) Encode(session fosite.Session) (string, error) {
+	m, ok := session.(protoMarshaler)
+	if !ok {
+		return "", errors.Errorf("%T doesn't implement Marshal() ([]byte, error)", session)
+	}
+	b, err := m.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// Decode base64 encoded binary to session.
+func (ProtoSessionCodec) Decode(data string, session fosite.Session) error {
+	m, ok := session.(protoUnmarshaler)
+	if !ok {
+		return errors.Errorf("%T doesn't implement Unmarshal([]byte) error", session)
+	}
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return err
+	}
+	return m.Unmarshal(b)
+}
+
+type sessionType struct {
+	tag        string
+	newSession func() fosite.Session
+	codec      SessionCodec
+}
+
+// SessionCodecRegistry holds session types and its codec.
+// the type tag is stored as DefaultRequester.SessionType, so various session types can be restored correctly.
+// nil *SessionCodecRegistry is valid and uses JSONSessionCodec for all sessions.
+type SessionCodecRegistry struct {
+	byTag  map[string]*sessionType
+	byType map[reflect.Type]*sessionType
+}
+
+// NewSessionCodecRegistry returns empty SessionCodecRegistry.
+func NewSessionCodecRegistry() *SessionCodecRegistry {
+	return &SessionCodecRegistry{
+		byTag:  make(map[string]*sessionType),
+		byType: make(map[reflect.Type]*sessionType),
+	}
+}
+
+// Register the session type made by newSession with the tag.
+func (r *SessionCodecRegistry) Register(tag string, newSession func() fosite.Session, codec SessionCodec) {
+	st := &sessionType{
+		tag:        tag,
+		newSession: newSession,
+		codec:      codec,
+	}
+	r.byTag[tag] = st
+	r.byType[reflect.TypeOf(newSession())] = st
+}
+
+// New returns new session of the tag. ok is false if the tag isn't registered.
+func (r *SessionCodecRegistry) New(tag string) (session fosite.Session, ok bool) {
+	if r == nil {
+		return nil, false
+	}
+	st, ok := r.byTag[tag]
+	if !ok {
+		return nil, false
+	}
+	return st.newSession(), true
+}
+
+// Encode session by the registered codec. unregistered session is encoded by JSONSessionCodec with empty tag.
+func (r *SessionCodecRegistry) Encode(session fosite.Session) (tag string, data string, err error) {
+	if r != nil {
+		if st, ok := r.byType[reflect.TypeOf(session)]; ok {
+			data, err := st.codec.Encode(session)
+			if err != nil {
+				return "", "", err
+			}
+			return st.tag, data, nil
+		}
+	}
+
+	data, err = JSONSessionCodec{}.Encode(session)
+	if err != nil {
+		return "", "", err
+	}
+	return "", data, nil
+}
+
+// Decode data to session by the codec of the tag.
+func (r *SessionCodecRegistry) Decode(tag string, data string, session fosite.Session) error {
+	if tag == "" {
+		return JSONSessionCodec{}.Decode(data, session)
+	}
+
+	if r != nil {
+		if st, ok := r.byTag[tag]; ok {
+			return st.codec.Decode(data, session)
+		}
+	}
+	return errors.Errorf("session type %s is not registered", tag)
+}
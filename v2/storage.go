@@ -2,7 +2,9 @@ package fdsstorage
 
 import (
 	"context"
-	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/handler/oauth2"
@@ -12,6 +14,8 @@ import (
 	"github.com/pkg/errors"
 	"go.mercari.io/datastore"
 	"golang.org/x/xerrors"
+	"google.golang.org/api/iterator"
+	"gopkg.in/square/go-jose.v2"
 )
 
 var _ Storage = (*datastoreStorage)(nil)
@@ -39,17 +43,79 @@ type Storage interface {
 
 	// original
 	CreateClient(ctx context.Context, client fosite.Client) error
+	UpdateClient(ctx context.Context, client fosite.Client) error
+	DeleteClient(ctx context.Context, id string) error
+	ListClients(ctx context.Context, cursor string, limit int) ([]fosite.Client, string, error)
+	ClientCacheStats() ClientCacheStats
+	PurgeExpired(ctx context.Context, before time.Time, opts *PurgeOptions) (map[string]int, error)
+	ListGrantsBySubject(ctx context.Context, subject string, opts *GrantOptions) ([]*Grant, error)
+	RevokeAllForSubject(ctx context.Context, subject string, opts *GrantOptions) error
+	MigrateRequestKeys(ctx context.Context, opts *MigrateKeysOptions) (map[string]int, error)
+	GetMultiRequesters(ctx context.Context, kind string, ids []string) ([]fosite.Requester, error)
+	RevokeTokensByAuthorizeCode(ctx context.Context, code string) error
+	RunInTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+	MigrateSchema(ctx context.Context, opts *MigrateSchemaOptions) (map[string]int, error)
+	CreateUser(ctx context.Context, name string, password string) error
+	UpdateUserPassword(ctx context.Context, name string, password string) error
+	UnlockUser(ctx context.Context, name string) error
+	DeleteUser(ctx context.Context, name string) error
+	CheckClientAuthRateLimit(ctx context.Context, clientID string) error
+	RecordClientAuthFailure(ctx context.Context, clientID string) error
+	RotateClientSecret(ctx context.Context, clientID string, newHash []byte, gracePeriod time.Duration) error
+	ResolveJSONWebKeys(ctx context.Context, location string, forceRefresh bool) (*jose.JSONWebKeySet, error)
+	JWKSFetcherStrategy(ctx context.Context) fosite.JWKSFetcherStrategy
 }
 
 // Config provides some settings.
 type Config struct {
 	DatastoreClient func(context.Context) (datastore.Client, error)
 
+	// NewClientEntity returns the client filled by GetClient. default is DefaultClient.
+	// *fosite.DefaultClient and *fosite.DefaultOpenIDConnectClient don't have rotated secrets,
+	// so the rotation by RotateClientSecret is not available, and UpdateClient drops them.
 	NewClientEntity func() fosite.Client
 	NewRequester    func() fosite.Requester
 	NewSession      func() fosite.Session
+	// NewSessionByKind overrides NewSession for each kind. e.g. {"FositeAccessToken": func() fosite.Session { return &oauth2.JWTSession{} }}
+	// it is used when fosite doesn't pass the session to restore.
+	NewSessionByKind map[string]func() fosite.Session
 
 	AuthenticateUser func(ctx context.Context, name, secret string) error
+	// UseUserStore makes Authenticate to verify users stored in UserKind. AuthenticateUser is ignored if it is true.
+	UseUserStore     bool
+	UserStoreOptions *UserStoreOptions
+	// RateLimiter limits failures of Authenticate and client authentication. default is nil, no limits.
+	RateLimiter *RateLimiterOptions
+	// JWKSResolverOptions provides settings for resolving JSONWebKeysURI of clients.
+	JWKSResolverOptions *JWKSResolverOptions
+
+	// InactiveRetention is how long deactivated requests (rotated refresh tokens and used OpenID Connect sessions) are kept to detect reuse.
+	// ExpiresAt of them is shortened to it, and PurgeExpired deletes them after that. default is 30 days.
+	InactiveRetention time.Duration
+
+	// AllowClientOverwrite makes CreateClient to overwrite the existing client that has same ID.
+	AllowClientOverwrite bool
+	// KeyNameDeriver derives key names of request entities from token signatures and authorize codes.
+	// default is nil, raw values are used as key names.
+	KeyNameDeriver KeyNameDeriver
+	// Encrypter encrypts sessions of requests and JSON Web Keys of clients.
+	// default is nil, they are stored as plaintext.
+	Encrypter Encrypter
+	// SessionCodecs encodes sessions by its type. default is nil, all sessions are encoded by JSON.
+	SessionCodecs *SessionCodecRegistry
+	// ClientCache caches clients loaded by GetClient. default is nil, clients are always loaded from Datastore.
+	ClientCache ClientCache
+	// TxMaxAttempts is the number of attempts of RunInTransaction on contention. default is 3.
+	TxMaxAttempts int
+	// TxBackoff returns the wait before the attempt of RunInTransaction. default is exponential from 100ms.
+	TxBackoff func(attempt int) time.Duration
+	// Namespace resolves Datastore namespace for each context. e.g. tenant ID.
+	// all keys and queries are scoped by it. default is nil, the default namespace is used.
+	// JWKSFetcherStrategy resolves it by the context given to it, the namespace is fixed for the lifetime of the provider.
+	Namespace func(ctx context.Context) string
+	// KeyLayout decides how request entities are grouped. default is FlatKeyLayout.
+	// RevokeTokensByAuthorizeCode and other revocations by the request ID are strongly consistent only with RequestAncestorKeyLayout.
+	KeyLayout KeyLayout
 
 	ClientKind        string
 	AuthorizeCodeKind string
@@ -57,6 +123,12 @@ type Config struct {
 	AccessTokenKind   string
 	RefreshTokenKind  string
 	PKCEKind          string
+	// RequestGroupKind and RequestGroupMemberKind are used by RequestAncestorKeyLayout.
+	RequestGroupKind       string
+	RequestGroupMemberKind string
+	UserKind               string
+	RateLimitKind          string
+	JWKSCacheKind          string
 }
 
 // NewStorage returns Storage by given Config.
@@ -93,7 +165,52 @@ func NewStorage(config *Config) (Storage, error) {
 			return &openid.DefaultSession{}
 		}
 	}
-	if config.AuthenticateUser != nil {
+	dsStorage.newSessionByKind = config.NewSessionByKind
+	dsStorage.userStoreOptions = &UserStoreOptions{}
+	if config.UserStoreOptions != nil {
+		*dsStorage.userStoreOptions = *config.UserStoreOptions
+	}
+	if dsStorage.userStoreOptions.Hasher == nil {
+		dsStorage.userStoreOptions.Hasher = &BCryptHasher{}
+	}
+	if dsStorage.userStoreOptions.MaxFailedAttempts <= 0 {
+		dsStorage.userStoreOptions.MaxFailedAttempts = 5
+	}
+	if dsStorage.userStoreOptions.FailureWindow <= 0 {
+		dsStorage.userStoreOptions.FailureWindow = 15 * time.Minute
+	}
+	if dsStorage.userStoreOptions.LockoutDuration <= 0 {
+		dsStorage.userStoreOptions.LockoutDuration = 15 * time.Minute
+	}
+	if config.RateLimiter != nil {
+		dsStorage.rateLimiter = &RateLimiterOptions{}
+		*dsStorage.rateLimiter = *config.RateLimiter
+		if dsStorage.rateLimiter.Shards <= 0 {
+			dsStorage.rateLimiter.Shards = 8
+		}
+	}
+	dsStorage.jwksResolverOptions = &JWKSResolverOptions{}
+	if config.JWKSResolverOptions != nil {
+		*dsStorage.jwksResolverOptions = *config.JWKSResolverOptions
+	}
+	if dsStorage.jwksResolverOptions.HTTPClient == nil {
+		dsStorage.jwksResolverOptions.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if dsStorage.jwksResolverOptions.MaxResponseSize <= 0 {
+		dsStorage.jwksResolverOptions.MaxResponseSize = 512 << 10
+	}
+	if dsStorage.jwksResolverOptions.Timeout <= 0 {
+		dsStorage.jwksResolverOptions.Timeout = 10 * time.Second
+	}
+	if dsStorage.jwksResolverOptions.DefaultTTL <= 0 {
+		dsStorage.jwksResolverOptions.DefaultTTL = time.Hour
+	}
+	if dsStorage.jwksResolverOptions.MinRefreshInterval <= 0 {
+		dsStorage.jwksResolverOptions.MinRefreshInterval = time.Minute
+	}
+	if config.UseUserStore {
+		dsStorage.authenticateUser = dsStorage.authenticateByUserStore
+	} else if config.AuthenticateUser != nil {
 		dsStorage.authenticateUser = config.AuthenticateUser
 	} else {
 		dsStorage.authenticateUser = func(ctx context.Context, name, secret string) error {
@@ -101,6 +218,29 @@ func NewStorage(config *Config) (Storage, error) {
 		}
 	}
 
+	if config.InactiveRetention > 0 {
+		dsStorage.inactiveRetention = config.InactiveRetention
+	} else {
+		dsStorage.inactiveRetention = 30 * 24 * time.Hour
+	}
+	dsStorage.allowClientOverwrite = config.AllowClientOverwrite
+	dsStorage.keyNameDeriver = config.KeyNameDeriver
+	dsStorage.encrypter = config.Encrypter
+	dsStorage.sessionCodecs = config.SessionCodecs
+	dsStorage.clientCache = config.ClientCache
+	dsStorage.namespace = config.Namespace
+	dsStorage.keyLayout = config.KeyLayout
+	if config.TxMaxAttempts > 0 {
+		dsStorage.txMaxAttempts = config.TxMaxAttempts
+	} else {
+		dsStorage.txMaxAttempts = 3
+	}
+	if config.TxBackoff != nil {
+		dsStorage.txBackoff = config.TxBackoff
+	} else {
+		dsStorage.txBackoff = defaultTxBackoff
+	}
+
 	if config.ClientKind != "" {
 		dsStorage.ClientKind = config.ClientKind
 	} else {
@@ -131,6 +271,31 @@ func NewStorage(config *Config) (Storage, error) {
 	} else {
 		dsStorage.PKCEKind = "FositePKCE"
 	}
+	if config.RequestGroupKind != "" {
+		dsStorage.RequestGroupKind = config.RequestGroupKind
+	} else {
+		dsStorage.RequestGroupKind = "FositeRequestGroup"
+	}
+	if config.RequestGroupMemberKind != "" {
+		dsStorage.RequestGroupMemberKind = config.RequestGroupMemberKind
+	} else {
+		dsStorage.RequestGroupMemberKind = "FositeRequestGroupMember"
+	}
+	if config.UserKind != "" {
+		dsStorage.UserKind = config.UserKind
+	} else {
+		dsStorage.UserKind = "FositeUser"
+	}
+	if config.RateLimitKind != "" {
+		dsStorage.RateLimitKind = config.RateLimitKind
+	} else {
+		dsStorage.RateLimitKind = "FositeRateLimit"
+	}
+	if config.JWKSCacheKind != "" {
+		dsStorage.JWKSCacheKind = config.JWKSCacheKind
+	} else {
+		dsStorage.JWKSCacheKind = "FositeJWKSCache"
+	}
 
 	return dsStorage, nil
 }
@@ -140,19 +305,54 @@ type datastoreStorage struct {
 	newClientEntity  func() fosite.Client
 	newRequester     func() fosite.Requester
 	newSession       func() fosite.Session
+	newSessionByKind map[string]func() fosite.Session
 	authenticateUser func(ctx context.Context, name, secret string) error
 
+	inactiveRetention    time.Duration
+	allowClientOverwrite bool
+	keyNameDeriver       KeyNameDeriver
+	encrypter            Encrypter
+	sessionCodecs        *SessionCodecRegistry
+	clientCache          ClientCache
+	txMaxAttempts        int
+	txBackoff            func(attempt int) time.Duration
+	namespace            func(ctx context.Context) string
+	keyLayout            KeyLayout
+	userStoreOptions     *UserStoreOptions
+	rateLimiter          *RateLimiterOptions
+	jwksResolverOptions  *JWKSResolverOptions
+
+	clientCacheHits   uint64
+	clientCacheMisses uint64
+
+	dummyPasswordHashOnce  sync.Once
+	dummyPasswordHashValue string
+
 	ClientKind        string
 	AuthorizeCodeKind string
 	IDSessionKind     string
 	AccessTokenKind   string
 	RefreshTokenKind  string
 	PKCEKind          string
+	// RequestGroupKind and RequestGroupMemberKind are used by RequestAncestorKeyLayout.
+	RequestGroupKind       string
+	RequestGroupMemberKind string
+	UserKind               string
+	RateLimitKind          string
+	JWKSCacheKind          string
 }
 
+// deleteBatchSize is the maximum number of entities which can be mutated in one commit.
+const deleteBatchSize = 500
+
 type contextTxKey struct{}
 
 func (s *datastoreStorage) BeginTX(ctx context.Context) (context.Context, error) {
+	if txCtx, ok := activeTxContext(ctx); ok {
+		// join the active transaction instead of beginning another one.
+		return context.WithValue(ctx, contextTxKey{}, &txContext{state: txCtx.state, joined: true}), nil
+	}
+
 	dsCli, err := s.datastoreClient(ctx)
 	if err != nil {
 		return nil, err
@@ -161,47 +361,114 @@ func (s *datastoreStorage) BeginTX(ctx context.Context) (context.Context, error)
 	if err != nil {
 		return ctx, err
 	}
-	ctx = context.WithValue(ctx, contextTxKey{}, tx)
+	ctx = context.WithValue(ctx, contextTxKey{}, &txContext{state: &txState{tx: tx}})
 	return ctx, nil
 }
 
 func (s *datastoreStorage) Commit(ctx context.Context) error {
-	tx, ok := ctx.Value(contextTxKey{}).(datastore.Transaction)
+	txCtx, ok := activeTxContext(ctx)
 	if !ok {
 		return errors.WithStack(errInvalidTxContext)
 	}
-	_, err := tx.Commit()
-	return err
+	if txCtx.joined {
+		return nil
+	}
+	if !txCtx.state.finish() {
+		return errors.WithStack(errInvalidTxContext)
+	}
+	if txCtx.state.isRollbackOnly() {
+		err := txCtx.state.tx.Rollback()
+		if err != nil {
+			return err
+		}
+		return errors.WithStack(errTxRollbackOnly)
+	}
+	_, err := txCtx.state.tx.Commit()
+	if err != nil {
+		return err
+	}
+	for _, fn := range txCtx.state.afterCommit {
+		fn()
+	}
+	return nil
 }
 
 func (s *datastoreStorage) Rollback(ctx context.Context) error {
-	tx, ok := ctx.Value(contextTxKey{}).(datastore.Transaction)
+	txCtx, ok := activeTxContext(ctx)
 	if !ok {
 		return errors.WithStack(errInvalidTxContext)
 	}
-	return tx.Rollback()
+	if txCtx.joined {
+		// the transaction can't be committed partially, the outermost Commit rolls back the whole transaction.
+		txCtx.state.markRollbackOnly()
+		return nil
+	}
+	if !txCtx.state.finish() {
+		return errors.WithStack(errInvalidTxContext)
+	}
+	return txCtx.state.tx.Rollback()
 }
 
 func (s *datastoreStorage) CreateClient(ctx context.Context, client fosite.Client) error {
-	dsCli, err := s.datastoreClient(ctx)
+	if s.allowClientOverwrite {
+		return s.putClient(ctx, client, clientPutUpsert)
+	}
+	return s.putClient(ctx, client, clientPutCreate)
+}
+
+func (s *datastoreStorage) UpdateClient(ctx context.Context, client fosite.Client) error {
+	return s.putClient(ctx, client, clientPutUpdate)
+}
+
+type clientPutMode int
+
+const (
+	clientPutUpsert clientPutMode = iota
+	clientPutCreate
+	clientPutUpdate
+)
+
+func (s *datastoreStorage) putClient(ctx context.Context, client fosite.Client, mode clientPutMode) error {
+	acc, err := s.accessor(ctx)
 	if err != nil {
 		return err
 	}
-	put := func(key datastore.Key, src interface{}) error {
-		_, err := dsCli.Put(ctx, key, src)
+
+	cliEntity, err := s.toClientEntity(client)
+	if err != nil {
 		return err
 	}
-	tx, ok := ctx.Value(contextTxKey{}).(datastore.Transaction)
-	if ok {
-		put = func(key datastore.Key, src interface{}) error {
-			_, err := tx.Put(key, src)
-			return err
+
+	defer s.invalidateCachedClient(ctx, client.GetID())
+
+	key := acc.NameKey(s.ClientKind, client.GetID(), nil)
+	return acc.RunInTransaction(func(tx datastore.Transaction) error {
+		if mode != clientPutUpsert {
+			err := tx.Get(key, &datastore.PropertyList{})
+			exists := true
+			if xerrors.Is(err, datastore.ErrNoSuchEntity) {
+				exists = false
+			} else if err != nil {
+				return err
+			}
+
+			if mode == clientPutCreate && exists {
+				return ErrClientAlreadyExists
+			} else if mode == clientPutUpdate && !exists {
+				return fosite.ErrNotFound
+			}
 		}
-	}
 
+		_, err := tx.Put(key, cliEntity)
+		return err
+	})
+}
+
+// toClientEntity returns the value which will be stored to Datastore for the client.
+func (s *datastoreStorage) toClientEntity(client fosite.Client) (interface{}, error) {
 	switch v := client.(type) {
 	case *fosite.DefaultClient:
-		cliEntity := &DefaultClient{}
+		cliEntity := &DefaultClient{Encrypter: s.encrypter}
 
 		cliEntity.ID = v.GetID()
 		cliEntity.Secret = v.GetHashedSecret()
@@ -212,14 +479,10 @@ func (s *datastoreStorage) CreateClient(ctx context.Context, client fosite.Clien
 		cliEntity.Audience = v.GetAudience()
 		cliEntity.Public = v.IsPublic()
 
-		key := dsCli.NameKey(s.ClientKind, client.GetID(), nil)
-		err := put(key, cliEntity)
-		if err != nil {
-			return err
-		}
+		return cliEntity, nil
 
 	case *fosite.DefaultOpenIDConnectClient:
-		cliEntity := &DefaultClient{}
+		cliEntity := &DefaultClient{Encrypter: s.encrypter}
 
 		cliEntity.ID = v.GetID()
 		cliEntity.Secret = v.GetHashedSecret()
@@ -235,52 +498,57 @@ func (s *datastoreStorage) CreateClient(ctx context.Context, client fosite.Clien
 		cliEntity.TokenEndpointAuthMethod = v.GetTokenEndpointAuthMethod()
 		cliEntity.RequestURIs = v.GetRequestURIs()
 		cliEntity.RequestObjectSigningAlgorithm = v.GetRequestObjectSigningAlgorithm()
+		cliEntity.TokenEndpointAuthSigningAlgorithm = v.GetTokenEndpointAuthSigningAlgorithm()
 
-		key := dsCli.NameKey(s.ClientKind, client.GetID(), nil)
-		err := put(key, cliEntity)
-		if err != nil {
-			return err
-		}
+		return cliEntity, nil
 
 	case datastore.PropertyLoadSaver:
-		key := dsCli.NameKey(s.ClientKind, client.GetID(), nil)
-		err := put(key, client)
-		if err != nil {
-			return err
+		if setter, ok := v.(EncrypterSetter); ok {
+			setter.SetEncrypter(s.encrypter)
 		}
+		return client, nil
 
 	default:
-		return errUnsupportedClientType
+		return nil, errUnsupportedClientType
 	}
-
-	return nil
 }
 
 func (s *datastoreStorage) GetClient(ctx context.Context, id string) (fosite.Client, error) {
-	dsCli, err := s.datastoreClient(ctx)
+	if client, ok := s.getCachedClient(ctx, id); ok {
+		rememberClient(ctx, client)
+		return client, nil
+	}
+
+	acc, err := s.accessor(ctx)
 	if err != nil {
 		return nil, err
 	}
-	get := func(key datastore.Key, src interface{}) error {
-		return dsCli.Get(ctx, key, src)
-	}
-	tx, ok := ctx.Value(contextTxKey{}).(datastore.Transaction)
-	if ok {
-		get = func(key datastore.Key, src interface{}) error {
-			return tx.Get(key, src)
-		}
+
+	key := acc.NameKey(s.ClientKind, id, nil)
+	client, err := s.loadClient(func(dst interface{}) error {
+		return acc.Get(key, dst)
+	})
+	if xerrors.Is(err, datastore.ErrNoSuchEntity) {
+		return nil, fosite.ErrNotFound
+	} else if err != nil {
+		return nil, err
 	}
 
+	s.setCachedClient(ctx, id, client)
+	rememberClient(ctx, client)
+
+	return client, nil
+}
+
+// loadClient creates new client and fills it by load function.
+func (s *datastoreStorage) loadClient(load func(dst interface{}) error) (fosite.Client, error) {
 	client := s.newClientEntity()
 
 	switch v := client.(type) {
 	case *fosite.DefaultClient:
-		cliEntity := &DefaultClient{}
-		key := dsCli.NameKey(s.ClientKind, id, nil)
-		err := get(key, cliEntity)
-		if xerrors.Is(err, datastore.ErrNoSuchEntity) {
-			return nil, fosite.ErrNotFound
-		} else if err != nil {
+		cliEntity := &DefaultClient{Encrypter: s.encrypter}
+		err := load(cliEntity)
+		if err != nil {
 			return nil, err
 		}
 
@@ -296,15 +564,15 @@ func (s *datastoreStorage) GetClient(ctx context.Context, id string) (fosite.Cli
 		return client, nil
 
 	case *fosite.DefaultOpenIDConnectClient:
-		cliEntity := &DefaultClient{}
-		key := dsCli.NameKey(s.ClientKind, id, nil)
-		err := get(key, cliEntity)
-		if xerrors.Is(err, datastore.ErrNoSuchEntity) {
-			return nil, fosite.ErrNotFound
-		} else if err != nil {
+		cliEntity := &DefaultClient{Encrypter: s.encrypter}
+		err := load(cliEntity)
+		if err != nil {
 			return nil, err
 		}
 
+		if v.DefaultClient == nil {
+			v.DefaultClient = &fosite.DefaultClient{}
+		}
 		v.ID = cliEntity.GetID()
 		v.Secret = cliEntity.GetHashedSecret()
 		v.RedirectURIs = cliEntity.GetRedirectURIs()
@@ -323,11 +591,11 @@ func (s *datastoreStorage) GetClient(ctx context.Context, id string) (fosite.Cli
 		return client, nil
 
 	case datastore.PropertyLoadSaver:
-		key := dsCli.NameKey(s.ClientKind, id, nil)
-		err := get(key, v)
-		if xerrors.Is(err, datastore.ErrNoSuchEntity) {
-			return nil, fosite.ErrNotFound
-		} else if err != nil {
+		if setter, ok := v.(EncrypterSetter); ok {
+			setter.SetEncrypter(s.encrypter)
+		}
+		err := load(v)
+		if err != nil {
 			return nil, err
 		}
 
@@ -338,26 +606,143 @@ func (s *datastoreStorage) GetClient(ctx context.Context, id string) (fosite.Cli
 	}
 }
 
-func (s *datastoreStorage) putRequestEntity(ctx context.Context, kind string, id string, request fosite.Requester, prePut func(request fosite.Requester) error) error {
-	dsCli, err := s.datastoreClient(ctx)
+func (s *datastoreStorage) DeleteClient(ctx context.Context, id string) error {
+	acc, err := s.accessor(ctx)
 	if err != nil {
 		return err
 	}
-	put := func(key datastore.Key, src interface{}) error {
-		_, err := dsCli.Put(ctx, key, src)
+
+	// revoke all outstanding grants of the client at first.
+	// they are deleted in batches out of the transaction, the client may have more tokens than a transaction allows.
+	kinds := []string{
+		s.AuthorizeCodeKind,
+		s.IDSessionKind,
+		s.AccessTokenKind,
+		s.RefreshTokenKind,
+		s.PKCEKind,
+		s.RequestGroupMemberKind,
+	}
+	for _, kind := range kinds {
+		err := s.deleteByClientID(acc.NoTx(), kind, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	defer s.invalidateCachedClient(ctx, id)
+
+	key := acc.NameKey(s.ClientKind, id, nil)
+	err = acc.Delete(key)
+	if xerrors.Is(err, datastore.ErrNoSuchEntity) {
+		return fosite.ErrNotFound
+	} else if err != nil {
 		return err
 	}
-	tx, ok := ctx.Value(contextTxKey{}).(datastore.Transaction)
-	if ok {
-		put = func(key datastore.Key, src interface{}) error {
-			_, err := tx.Put(key, src)
+	return nil
+}
+
+// deleteByClientID deletes entities of the kind that have the client ID, page by page.
+// the entity groups of RequestAncestorKeyLayout are deleted with their members.
+func (s *datastoreStorage) deleteByClientID(acc *dsAccessor, kind string, clientID string) error {
+	var cursor datastore.Cursor
+	for {
+		q := acc.NewQuery(kind).Filter("ClientID =", clientID).KeysOnly().Limit(deleteBatchSize)
+		if cursor != nil {
+			q = q.Start(cursor)
+		}
+
+		var keys, groupKeys []datastore.Key
+		groups := make(map[string]bool)
+		it := acc.Run(q)
+		for {
+			key, err := it.Next(nil)
+			if err == iterator.Done {
+				break
+			} else if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+
+			if parent := key.ParentKey(); kind == s.RequestGroupMemberKind && parent != nil && !groups[parent.String()] {
+				groups[parent.String()] = true
+				groupKeys = append(groupKeys, parent)
+			}
+		}
+
+		err := s.deleteKeys(acc, append(keys, groupKeys...))
+		if err != nil {
 			return err
 		}
+
+		if len(keys) < deleteBatchSize {
+			return nil
+		}
+		cursor, err = it.Cursor()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *datastoreStorage) ListClients(ctx context.Context, cursor string, limit int) ([]fosite.Client, string, error) {
+	acc, err := s.accessor(ctx)
+	if err != nil {
+		return nil, "", err
 	}
 
+	q := acc.NewQuery(s.ClientKind)
+	if cursor != "" {
+		c, err := acc.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.Start(c)
+	}
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	var clients []fosite.Client
+	it := acc.Run(q)
+	for {
+		client, err := s.loadClient(func(dst interface{}) error {
+			_, err := it.Next(dst)
+			return err
+		})
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		clients = append(clients, client)
+	}
+
+	if limit <= 0 || len(clients) < limit {
+		return clients, "", nil
+	}
+
+	c, err := it.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return clients, c.String(), nil
+}
+
+func (s *datastoreStorage) putRequestEntity(ctx context.Context, kind string, id string, request fosite.Requester, prePut func(request fosite.Requester) error) error {
+	return s.putRequestEntityByName(ctx, kind, s.requestKeyNames(kind, id)[0], request, prePut)
+}
+
+func (s *datastoreStorage) putRequestEntityByName(ctx context.Context, kind string, name string, request fosite.Requester, prePut func(request fosite.Requester) error) error {
+	acc, err := s.accessor(ctx)
+	if err != nil {
+		return err
+	}
+
+	var expiresAt time.Time
 	switch v := request.(type) {
 	case *fosite.Request:
-		reqEntity := &DefaultRequester{}
+		reqEntity := s.newRequesterEntity()
 
 		reqEntity.ID = v.GetID()
 		reqEntity.RequestedAt = v.GetRequestedAt()
@@ -368,21 +753,23 @@ func (s *datastoreStorage) putRequestEntity(ctx context.Context, kind string, id
 		reqEntity.Session = v.GetSession()
 		reqEntity.RequestedAudience = v.GetRequestedAudience()
 		reqEntity.GrantedAudience = v.GetGrantedAudience()
+		reqEntity.ExpiresAt = s.sessionExpiresAt(kind, v.GetSession())
 
-		key := dsCli.NameKey(kind, id, nil)
+		key := acc.NameKey(kind, name, nil)
 		if prePut != nil {
 			err := prePut(reqEntity)
 			if err != nil {
 				return err
 			}
 		}
-		err = put(key, reqEntity)
+		err = acc.Put(key, reqEntity)
 		if err != nil {
 			return err
 		}
+		expiresAt = reqEntity.ExpiresAt
 
 	case *fosite.AccessRequest:
-		reqEntity := &DefaultRequester{}
+		reqEntity := s.newRequesterEntity()
 
 		reqEntity.ID = v.GetID()
 		reqEntity.RequestedAt = v.GetRequestedAt()
@@ -393,24 +780,26 @@ func (s *datastoreStorage) putRequestEntity(ctx context.Context, kind string, id
 		reqEntity.Session = v.GetSession()
 		reqEntity.RequestedAudience = v.GetRequestedAudience()
 		reqEntity.GrantedAudience = v.GetGrantedAudience()
+		reqEntity.ExpiresAt = s.sessionExpiresAt(kind, v.GetSession())
 
 		reqEntity.GrantTypes = v.GetGrantTypes()
 		reqEntity.HandledGrantType = v.HandledGrantType
 
-		key := dsCli.NameKey(kind, id, nil)
+		key := acc.NameKey(kind, name, nil)
 		if prePut != nil {
 			err := prePut(reqEntity)
 			if err != nil {
 				return err
 			}
 		}
-		err = put(key, reqEntity)
+		err = acc.Put(key, reqEntity)
 		if err != nil {
 			return err
 		}
+		expiresAt = reqEntity.ExpiresAt
 
 	case *fosite.AuthorizeRequest:
-		reqEntity := &DefaultRequester{}
+		reqEntity := s.newRequesterEntity()
 
 		reqEntity.ID = v.GetID()
 		reqEntity.RequestedAt = v.GetRequestedAt()
@@ -421,6 +810,7 @@ func (s *datastoreStorage) putRequestEntity(ctx context.Context, kind string, id
 		reqEntity.Session = v.GetSession()
 		reqEntity.RequestedAudience = v.GetRequestedAudience()
 		reqEntity.GrantedAudience = v.GetGrantedAudience()
+		reqEntity.ExpiresAt = s.sessionExpiresAt(kind, v.GetSession())
 
 		reqEntity.ResponseTypes = v.GetResponseTypes()
 		if v.GetRedirectURI() != nil {
@@ -429,79 +819,126 @@ func (s *datastoreStorage) putRequestEntity(ctx context.Context, kind string, id
 		reqEntity.State = v.GetState()
 		reqEntity.HandledResponseTypes = v.HandledResponseTypes
 
-		key := dsCli.NameKey(kind, id, nil)
+		key := acc.NameKey(kind, name, nil)
 		if prePut != nil {
 			err := prePut(reqEntity)
 			if err != nil {
 				return err
 			}
 		}
-		err = put(key, reqEntity)
+		err = acc.Put(key, reqEntity)
 		if err != nil {
 			return err
 		}
+		expiresAt = reqEntity.ExpiresAt
 
 	case datastore.PropertyLoadSaver:
-		key := dsCli.NameKey(kind, id, nil)
+		key := acc.NameKey(kind, name, nil)
+		s.injectRequesterDependencies(v)
+		if modifier, ok := v.(ExpiresAtModifier); ok {
+			modifier.SetExpiresAt(s.sessionExpiresAt(kind, request.GetSession()))
+		}
 		if prePut != nil {
 			err := prePut(request)
 			if err != nil {
 				return err
 			}
 		}
-		err = put(key, request)
+		err = acc.Put(key, request)
 		if err != nil {
 			return err
 		}
+		if modifier, ok := v.(ExpiresAtModifier); ok {
+			expiresAt = modifier.GetExpiresAt()
+		}
 
 	default:
 		return errUnsupportedRequesterType
 	}
 
-	return nil
+	return s.putRequestGroupMember(acc, kind, name, request, expiresAt)
 }
 
-func (s *datastoreStorage) getRequestEntity(ctx context.Context, kind string, id string) (fosite.Requester, error) {
-	dsCli, err := s.datastoreClient(ctx)
+func (s *datastoreStorage) getRequestEntity(ctx context.Context, kind string, id string, session fosite.Session) (fosite.Requester, error) {
+	request, _, err := s.getRequestEntityByNames(ctx, kind, s.requestKeyNames(kind, id), session)
+	return request, err
+}
+
+// getRequestEntityByNames tries key names in order, and returns the first found entity and its key name.
+// the stored session is restored into the given session if it isn't nil.
+func (s *datastoreStorage) getRequestEntityByNames(ctx context.Context, kind string, names []string, session fosite.Session) (fosite.Requester, string, error) {
+	acc, err := s.accessor(ctx)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	get := func(key datastore.Key, src interface{}) error {
-		return dsCli.Get(ctx, key, src)
-	}
-	tx, ok := ctx.Value(contextTxKey{}).(datastore.Transaction)
-	if ok {
-		get = func(key datastore.Key, src interface{}) error {
-			return tx.Get(key, src)
+	var name string
+	get := func(src interface{}) error {
+		var err error
+		for _, n := range names {
+			err = acc.Get(acc.NameKey(kind, n, nil), src)
+			if xerrors.Is(err, datastore.ErrNoSuchEntity) {
+				continue
+			}
+			name = n
+			return err
 		}
+		return err
 	}
 
 	request := s.newRequester()
+	dst, err := s.requestEntityDst(request)
+	if err != nil {
+		return nil, "", err
+	}
+	err = get(dst)
+	if xerrors.Is(err, datastore.ErrNoSuchEntity) {
+		return nil, "", fosite.ErrNotFound
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	request, err = s.completeRequestEntity(ctx, kind, request, dst, session, func(id string) (fosite.Client, error) {
+		return s.GetClient(ctx, id)
+	})
+	return request, name, err
+}
 
+// requestEntityDst returns the value to load the entity of the request.
+func (s *datastoreStorage) requestEntityDst(request fosite.Requester) (interface{}, error) {
+	switch v := request.(type) {
+	case *fosite.Request, *fosite.AccessRequest, *fosite.AuthorizeRequest:
+		return s.newRequesterEntity(), nil
+
+	case datastore.PropertyLoadSaver:
+		s.injectRequesterDependencies(v)
+		return v, nil
+
+	default:
+		return nil, errUnsupportedRequesterType
+	}
+}
+
+// completeRequestEntity fills the request by the loaded entity, and restores its client and session.
+func (s *datastoreStorage) completeRequestEntity(ctx context.Context, kind string, request fosite.Requester, loaded interface{}, session fosite.Session, getClient func(id string) (fosite.Client, error)) (fosite.Requester, error) {
 	switch v := request.(type) {
 	case *fosite.Request:
-		reqEntity := &DefaultRequester{}
-		key := dsCli.NameKey(kind, id, nil)
-		err := get(key, reqEntity)
-		if xerrors.Is(err, datastore.ErrNoSuchEntity) {
+		reqEntity := loaded.(*DefaultRequester)
+		if isExpired(reqEntity.ExpiresAt) {
 			return nil, fosite.ErrNotFound
-		} else if err != nil {
-			return nil, err
 		}
 
-		client, err := s.GetClient(ctx, reqEntity.ClientID)
+		client, err := getClient(reqEntity.ClientID)
 		if err != nil {
 			return nil, err
 		}
 		reqEntity.Client = client
 
 		if reqEntity.SessionJSON != "" {
-			session := s.newSession()
-			err = json.Unmarshal([]byte(reqEntity.SessionJSON), session)
+			session := s.sessionFor(kind, reqEntity.SessionType, session)
+			err := reqEntity.RestoreSession(ctx, session)
 			if err != nil {
 				return nil, err
 			}
-			reqEntity.Session = session
 		}
 
 		v.ID = reqEntity.GetID()
@@ -520,28 +957,23 @@ func (s *datastoreStorage) getRequestEntity(ctx context.Context, kind string, id
 		return v, nil
 
 	case *fosite.AccessRequest:
-		reqEntity := &DefaultRequester{}
-		key := dsCli.NameKey(kind, id, nil)
-		err := get(key, reqEntity)
-		if xerrors.Is(err, datastore.ErrNoSuchEntity) {
+		reqEntity := loaded.(*DefaultRequester)
+		if isExpired(reqEntity.ExpiresAt) {
 			return nil, fosite.ErrNotFound
-		} else if err != nil {
-			return nil, err
 		}
 
-		client, err := s.GetClient(ctx, reqEntity.ClientID)
+		client, err := getClient(reqEntity.ClientID)
 		if err != nil {
 			return nil, err
 		}
 		reqEntity.Client = client
 
 		if reqEntity.SessionJSON != "" {
-			session := s.newSession()
-			err = json.Unmarshal([]byte(reqEntity.SessionJSON), session)
+			session := s.sessionFor(kind, reqEntity.SessionType, session)
+			err := reqEntity.RestoreSession(ctx, session)
 			if err != nil {
 				return nil, err
 			}
-			reqEntity.Session = session
 		}
 
 		v.ID = reqEntity.GetID()
@@ -563,28 +995,23 @@ func (s *datastoreStorage) getRequestEntity(ctx context.Context, kind string, id
 		return v, nil
 
 	case *fosite.AuthorizeRequest:
-		reqEntity := &DefaultRequester{}
-		key := dsCli.NameKey(kind, id, nil)
-		err := tx.Get(key, reqEntity)
-		if xerrors.Is(err, datastore.ErrNoSuchEntity) {
+		reqEntity := loaded.(*DefaultRequester)
+		if isExpired(reqEntity.ExpiresAt) {
 			return nil, fosite.ErrNotFound
-		} else if err != nil {
-			return nil, err
 		}
 
-		client, err := s.GetClient(ctx, reqEntity.ClientID)
+		client, err := getClient(reqEntity.ClientID)
 		if err != nil {
 			return nil, err
 		}
 		reqEntity.Client = client
 
 		if reqEntity.SessionJSON != "" {
-			session := s.newSession()
-			err = json.Unmarshal([]byte(reqEntity.SessionJSON), session)
+			session := s.sessionFor(kind, reqEntity.SessionType, session)
+			err := reqEntity.RestoreSession(ctx, session)
 			if err != nil {
 				return nil, err
 			}
-			reqEntity.Session = session
 		}
 
 		v.ID = reqEntity.GetID()
@@ -608,12 +1035,8 @@ func (s *datastoreStorage) getRequestEntity(ctx context.Context, kind string, id
 		return v, nil
 
 	case datastore.PropertyLoadSaver:
-		key := dsCli.NameKey(kind, id, nil)
-		err := get(key, v)
-		if xerrors.Is(err, datastore.ErrNoSuchEntity) {
+		if modifier, ok := v.(ExpiresAtModifier); ok && isExpired(modifier.GetExpiresAt()) {
 			return nil, fosite.ErrNotFound
-		} else if err != nil {
-			return nil, err
 		}
 
 		invalidator, ok := v.(ActiveStateModifier)
@@ -630,7 +1053,7 @@ func (s *datastoreStorage) getRequestEntity(ctx context.Context, kind string, id
 				return nil, errRequesterNeedsClientLoader
 			}
 			if clientLoader.GetClientID() != "" {
-				client, err := s.GetClient(ctx, clientLoader.GetClientID())
+				client, err := getClient(clientLoader.GetClientID())
 				if err != nil {
 					return nil, err
 				}
@@ -638,7 +1061,11 @@ func (s *datastoreStorage) getRequestEntity(ctx context.Context, kind string, id
 			}
 		}
 		if sessionLoader, ok := v.(SessionRestorer); ok {
-			session := s.newSession()
+			var tag string
+			if typeGetter, ok := v.(SessionTypeGetter); ok {
+				tag = typeGetter.GetSessionType()
+			}
+			session := s.sessionFor(kind, tag, session)
 			err := sessionLoader.RestoreSession(ctx, session)
 			if err != nil {
 				return nil, err
@@ -652,28 +1079,113 @@ func (s *datastoreStorage) getRequestEntity(ctx context.Context, kind string, id
 	}
 }
 
+func (s *datastoreStorage) newRequesterEntity() *DefaultRequester {
+	return &DefaultRequester{
+		Encrypter:     s.encrypter,
+		SessionCodecs: s.sessionCodecs,
+	}
+}
+
+// injectRequesterDependencies sets dependencies of the storage to the requester if it needs.
+func (s *datastoreStorage) injectRequesterDependencies(request interface{}) {
+	if setter, ok := request.(EncrypterSetter); ok {
+		setter.SetEncrypter(s.encrypter)
+	}
+	if setter, ok := request.(SessionCodecRegistrySetter); ok {
+		setter.SetSessionCodecRegistry(s.sessionCodecs)
+	}
+}
+
+// sessionFor returns the session to restore the stored one.
+// it prefers the session passed from fosite, the session type registered with the tag,
+// Config.NewSessionByKind and Config.NewSession in that order.
+func (s *datastoreStorage) sessionFor(kind string, tag string, session fosite.Session) fosite.Session {
+	if session != nil {
+		return session
+	}
+	if session, ok := s.sessionCodecs.New(tag); ok {
+		return session
+	}
+	if newSession, ok := s.newSessionByKind[kind]; ok {
+		return newSession()
+	}
+	return s.newSession()
+}
+
+// requestKeyNames returns Datastore key names of the request entity.
+// the first one is used to store, all of them are used to load and delete.
+func (s *datastoreStorage) requestKeyNames(kind string, id string) []string {
+	if s.keyNameDeriver == nil {
+		return []string{id}
+	}
+	return s.keyNameDeriver.DeriveKeyNames(kind, id)
+}
+
+// tokenTypeByKind returns the fosite.TokenType which decides the lifespan of entities in the kind.
+func (s *datastoreStorage) tokenTypeByKind(kind string) fosite.TokenType {
+	switch kind {
+	case s.AccessTokenKind:
+		return fosite.AccessToken
+	case s.RefreshTokenKind:
+		return fosite.RefreshToken
+	default:
+		// authorize code, OpenID Connect session and PKCE are keyed by authorize code.
+		return fosite.AuthorizeCode
+	}
+}
+
+func (s *datastoreStorage) sessionExpiresAt(kind string, session fosite.Session) time.Time {
+	if session == nil {
+		return time.Time{}
+	}
+	return session.GetExpiresAt(s.tokenTypeByKind(kind))
+}
+
+func isExpired(expiresAt time.Time) bool {
+	if expiresAt.IsZero() {
+		return false
+	}
+	return !time.Now().Before(expiresAt)
+}
+
 func (s *datastoreStorage) deleteRequestEntity(ctx context.Context, kind string, id string) error {
-	dsCli, err := s.datastoreClient(ctx)
+	acc, err := s.accessor(ctx)
 	if err != nil {
 		return err
 	}
-	del := func(key datastore.Key) error {
-		return dsCli.Delete(ctx, key)
+
+	names := s.requestKeyNames(kind, id)
+	err = s.deleteRequestGroupMembers(acc, kind, names)
+	if err != nil {
+		return err
 	}
-	tx, ok := ctx.Value(contextTxKey{}).(datastore.Transaction)
-	if ok {
-		del = func(key datastore.Key) error {
-			return tx.Delete(key)
+
+	for _, name := range names {
+		key := acc.NameKey(kind, name, nil)
+		err = acc.Delete(key)
+		if xerrors.Is(err, datastore.ErrNoSuchEntity) {
+			return fosite.ErrNotFound
+		} else if err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	key := dsCli.NameKey(kind, id, nil)
-	err = del(key)
-	if xerrors.Is(err, datastore.ErrNoSuchEntity) {
-		return fosite.ErrNotFound
-	} else if err != nil {
-		return err
+// deleteKeys deletes entities in batches. it works in transaction if acc has it.
+func (s *datastoreStorage) deleteKeys(acc *dsAccessor, keys []datastore.Key) error {
+	for len(keys) != 0 {
+		size := len(keys)
+		if deleteBatchSize < size {
+			size = deleteBatchSize
+		}
+		err := acc.DeleteMulti(keys[:size])
+		if err != nil {
+			return err
+		}
+		keys = keys[size:]
 	}
+
 	return nil
 }
 
@@ -689,15 +1201,15 @@ func (s *datastoreStorage) CreateAuthorizeCodeSession(ctx context.Context, code
 }
 
 func (s *datastoreStorage) GetAuthorizeCodeSession(ctx context.Context, code string, session fosite.Session) (fosite.Requester, error) {
-	return s.getRequestEntity(ctx, s.AuthorizeCodeKind, code)
+	return s.getRequestEntity(ctx, s.AuthorizeCodeKind, code, session)
 }
 
 func (s *datastoreStorage) InvalidateAuthorizeCodeSession(ctx context.Context, code string) error {
-	request, err := s.getRequestEntity(ctx, s.AuthorizeCodeKind, code)
+	request, name, err := s.getRequestEntityByNames(ctx, s.AuthorizeCodeKind, s.requestKeyNames(s.AuthorizeCodeKind, code), nil)
 	if err != nil {
 		return err
 	}
-	return s.putRequestEntity(ctx, s.AuthorizeCodeKind, code, request, func(request fosite.Requester) error {
+	return s.putRequestEntityByName(ctx, s.AuthorizeCodeKind, name, request, func(request fosite.Requester) error {
 		invalidator, ok := request.(ActiveStateModifier)
 		if !ok {
 			return errRequesterNeedsActiveStateModifier
@@ -719,7 +1231,7 @@ func (s *datastoreStorage) CreateAccessTokenSession(ctx context.Context, signatu
 }
 
 func (s *datastoreStorage) GetAccessTokenSession(ctx context.Context, signature string, session fosite.Session) (request fosite.Requester, err error) {
-	return s.getRequestEntity(ctx, s.AccessTokenKind, signature)
+	return s.getRequestEntity(ctx, s.AccessTokenKind, signature, session)
 }
 
 func (s *datastoreStorage) DeleteAccessTokenSession(ctx context.Context, signature string) (err error) {
@@ -738,48 +1250,155 @@ func (s *datastoreStorage) CreateRefreshTokenSession(ctx context.Context, signat
 }
 
 func (s *datastoreStorage) GetRefreshTokenSession(ctx context.Context, signature string, session fosite.Session) (request fosite.Requester, err error) {
-	return s.getRequestEntity(ctx, s.RefreshTokenKind, signature)
+	request, err = s.getRequestEntity(ctx, s.RefreshTokenKind, signature, session)
+	if xerrors.Is(err, fosite.ErrInvalidatedAuthorizeCode) {
+		// rotated refresh token is presented again. it may be stolen, so revoke the whole token family.
+		// see https://tools.ietf.org/html/draft-ietf-oauth-security-topics-12#section-4.12
+		err = s.revokeTokenFamily(ctx, request.GetID())
+		if err != nil {
+			return nil, err
+		}
+		// fosite v0.29 responds fosite.ErrNotFound as invalid_request instead of server_error.
+		return nil, wrapNotFound(ErrRefreshTokenReused)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return request, nil
 }
 
 func (s *datastoreStorage) DeleteRefreshTokenSession(ctx context.Context, signature string) (err error) {
-	return s.deleteRequestEntity(ctx, s.RefreshTokenKind, signature)
+	// keep the refresh token as inactive to detect reuse.
+	return s.deactivateRequestEntity(ctx, s.RefreshTokenKind, s.requestKeyNames(s.RefreshTokenKind, signature))
 }
 
-func (s *datastoreStorage) RevokeRefreshToken(ctx context.Context, requestID string) error {
-	dsCli, err := s.datastoreClient(ctx)
-	if err != nil {
+// revokeTokenFamily revokes all access tokens and refresh tokens that share the request ID.
+// it doesn't use the transaction in ctx because the caller will rollback it after the reuse error.
+func (s *datastoreStorage) revokeTokenFamily(ctx context.Context, requestID string) error {
+	ctx = context.WithValue(ctx, contextTxKey{}, nil)
+
+	return s.RevokeRefreshToken(ctx, requestID)
+}
+
+// deactivateRequestEntity marks the entity as inactive but retains it until Config.InactiveRetention passes.
+func (s *datastoreStorage) deactivateRequestEntity(ctx context.Context, kind string, names []string) error {
+	request, name, err := s.getRequestEntityByNames(ctx, kind, names, nil)
+	if xerrors.Is(err, fosite.ErrInvalidatedAuthorizeCode) {
+		return nil
+	} else if err != nil {
 		return err
 	}
-	q := dsCli.NewQuery(s.RefreshTokenKind).Filter("ID =", requestID).KeysOnly().Limit(1)
-	keys, err := dsCli.GetAll(ctx, q, nil)
-	if err != nil {
-		return err
+	return s.putRequestEntityByName(ctx, kind, name, request, func(request fosite.Requester) error {
+		invalidator, ok := request.(ActiveStateModifier)
+		if !ok {
+			return errRequesterNeedsActiveStateModifier
+		}
+		invalidator.SetActive(false)
+
+		// fosite v0.29 doesn't set the expiry of refresh tokens, so PurgeExpired can't delete them without this.
+		if modifier, ok := request.(ExpiresAtModifier); ok {
+			retainUntil := time.Now().Add(s.inactiveRetention)
+			if expiresAt := modifier.GetExpiresAt(); expiresAt.IsZero() || retainUntil.Before(expiresAt) {
+				modifier.SetExpiresAt(retainUntil)
+			}
+		}
+		return nil
+	})
+}
+
+// RevokeRefreshToken revokes the whole grant of the request ID.
+// access tokens and PKCE requests are deleted,
+// refresh tokens are retained as inactive to detect reuse after rotation.
+// OpenID Connect sessions are left to DeleteOpenIDConnectSession,
+// fosite calls this on every refresh and the inactive session detects replay of the authorize code.
+func (s *datastoreStorage) RevokeRefreshToken(ctx context.Context, requestID string) error {
+	var errs MultiError
+
+	err := s.deleteByRequestID(ctx, requestID, s.AccessTokenKind, s.PKCEKind)
+	if merr, ok := err.(MultiError); ok {
+		errs = append(errs, merr...)
+	} else if err != nil {
+		errs = append(errs, err)
+	}
+
+	err = s.deactivateByRequestID(ctx, requestID, s.RefreshTokenKind)
+	if merr, ok := err.(MultiError); ok {
+		errs = append(errs, merr...)
+	} else if err != nil {
+		errs = append(errs, err)
 	}
-	if len(keys) != 0 {
-		_ = s.DeleteRefreshTokenSession(ctx, keys[0].Name())
-		_ = s.DeleteAccessTokenSession(ctx, keys[0].Name())
+
+	if len(errs) != 0 {
+		return errs
 	}
 	return nil
 }
 
+// RevokeAccessToken deletes all access tokens of the request ID.
 func (s *datastoreStorage) RevokeAccessToken(ctx context.Context, requestID string) error {
-	dsCli, err := s.datastoreClient(ctx)
+	return s.deleteByRequestID(ctx, requestID, s.AccessTokenKind)
+}
+
+// deleteByRequestID deletes all entities of the kinds that have the request ID.
+// it continues even if some kinds fail, and returns MultiError.
+func (s *datastoreStorage) deleteByRequestID(ctx context.Context, requestID string, kinds ...string) error {
+	acc, err := s.accessor(ctx)
 	if err != nil {
 		return err
 	}
-	q := dsCli.NewQuery(s.AccessTokenKind).Filter("ID =", requestID).KeysOnly().Limit(1)
-	keys, err := dsCli.GetAll(ctx, q, nil)
+
+	var errs MultiError
+	for _, kind := range kinds {
+		keys, memberKeys, err := s.requestKeysByRequestID(acc, kind, requestID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		err = s.deleteKeys(acc, append(keys, memberKeys...))
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// deactivateByRequestID marks all entities of the kinds that have the request ID as inactive.
+// it continues even if some entities fail, and returns MultiError.
+func (s *datastoreStorage) deactivateByRequestID(ctx context.Context, requestID string, kinds ...string) error {
+	acc, err := s.accessor(ctx)
 	if err != nil {
 		return err
 	}
-	if len(keys) != 0 {
-		_ = s.DeleteAccessTokenSession(ctx, keys[0].Name())
+
+	var errs MultiError
+	for _, kind := range kinds {
+		keys, _, err := s.requestKeysByRequestID(acc, kind, requestID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, key := range keys {
+			err := s.deactivateRequestEntity(ctx, kind, []string{key.Name()})
+			if xerrors.Is(err, fosite.ErrNotFound) {
+				continue
+			} else if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
 	}
 	return nil
 }
 
 func (s *datastoreStorage) Authenticate(ctx context.Context, name string, secret string) error {
-	return s.authenticateUser(ctx, name, secret)
+	return s.authenticate(ctx, name, secret)
 }
 
 func (s *datastoreStorage) CreateOpenIDConnectSession(ctx context.Context, authorizeCode string, request fosite.Requester) error {
@@ -795,11 +1414,16 @@ func (s *datastoreStorage) CreateOpenIDConnectSession(ctx context.Context, autho
 }
 
 func (s *datastoreStorage) GetOpenIDConnectSession(ctx context.Context, authorizeCode string, requester fosite.Requester) (fosite.Requester, error) {
-	return s.getRequestEntity(ctx, s.RefreshTokenKind, authorizeCode)
+	var session fosite.Session
+	if requester != nil {
+		session = requester.GetSession()
+	}
+	return s.getRequestEntity(ctx, s.IDSessionKind, authorizeCode, session)
 }
 
 func (s *datastoreStorage) DeleteOpenIDConnectSession(ctx context.Context, authorizeCode string) error {
-	return s.deleteRequestEntity(ctx, s.RefreshTokenKind, authorizeCode)
+	// retain the session as inactive to detect replay of the authorize code.
+	return s.deactivateRequestEntity(ctx, s.IDSessionKind, s.requestKeyNames(s.IDSessionKind, authorizeCode))
 }
 
 func (s *datastoreStorage) CreatePKCERequestSession(ctx context.Context, signature string, request fosite.Requester) error {
@@ -814,7 +1438,7 @@ func (s *datastoreStorage) CreatePKCERequestSession(ctx context.Context, signatu
 }
 
 func (s *datastoreStorage) GetPKCERequestSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
-	return s.getRequestEntity(ctx, s.PKCEKind, signature)
+	return s.getRequestEntity(ctx, s.PKCEKind, signature, session)
 }
 
 func (s *datastoreStorage) DeletePKCERequestSession(ctx context.Context, signature string) error {
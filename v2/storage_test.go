@@ -0,0 +1,2608 @@
+package fdsstorage
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cloudds "cloud.google.com/go/datastore"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/pkg/errors"
+	"github.com/vvakame/fosite-datastore-storage/v2/memdatastore"
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/clouddatastore"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/xerrors"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// storageTestCase runs on every backend of testBackends.
+type storageTestCase struct {
+	name      string
+	configure func(config *Config)
+	test      func(t *testing.T, env *storageTestEnv)
+}
+
+// storageTestEnv is the isolated environment of storageTestCase.
+type storageTestEnv struct {
+	ctx       context.Context
+	client    datastore.Client
+	namespace string
+	store     Storage
+}
+
+// newStorage returns another Storage that shares entities with env.store.
+func (env *storageTestEnv) newStorage(t *testing.T, configure func(config *Config)) Storage {
+	config := &Config{
+		DatastoreClient: func(ctx context.Context) (datastore.Client, error) {
+			return env.client, nil
+		},
+	}
+	if configure != nil {
+		configure(config)
+	}
+	if env.namespace != "" {
+		// isolate the test on the shared emulator. the configured namespace is nested in it.
+		namespace := config.Namespace
+		config.Namespace = func(ctx context.Context) string {
+			if namespace == nil {
+				return env.namespace
+			}
+			if ns := namespace(ctx); ns != "" {
+				return env.namespace + "." + ns
+			}
+			return env.namespace
+		}
+	}
+
+	store, err := NewStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// testBackend provides datastore.Client for storageTestCase.
+type testBackend struct {
+	name string
+	// open returns the client and the namespace that isolates the test.
+	open func(t *testing.T) (datastore.Client, string)
+}
+
+// testBackends returns memdatastore, and Cloud Datastore emulator if DATASTORE_EMULATOR_HOST is set.
+// run the emulator with --consistency=1.0 because some cases use global queries.
+func testBackends() []*testBackend {
+	backends := []*testBackend{
+		{
+			name: "memdatastore",
+			open: func(t *testing.T) (datastore.Client, string) {
+				return memdatastore.New(), ""
+			},
+		},
+	}
+	if os.Getenv("DATASTORE_EMULATOR_HOST") != "" {
+		backends = append(backends, &testBackend{
+			name: "emulator",
+			open: openEmulator,
+		})
+	}
+	return backends
+}
+
+var emulatorNamespaceSeq int64
+
+func openEmulator(t *testing.T) (datastore.Client, string) {
+	ctx := context.Background()
+	projectID := os.Getenv("DATASTORE_PROJECT_ID")
+	if projectID == "" {
+		projectID = "fdsstorage-test"
+	}
+	cloudCli, err := cloudds.NewClient(ctx, projectID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := clouddatastore.FromClient(ctx, cloudCli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := fmt.Sprintf("fdsstorage-test-%d-%d", time.Now().UnixNano(), atomic.AddInt64(&emulatorNamespaceSeq, 1))
+	return client, ns
+}
+
+// runStorageTests runs cases on every backend.
+func runStorageTests(t *testing.T, cases []*storageTestCase) {
+	for _, backend := range testBackends() {
+		for _, tc := range cases {
+			backend, tc := backend, tc
+			t.Run(backend.name+"/"+tc.name, func(t *testing.T) {
+				client, ns := backend.open(t)
+				defer client.Close()
+
+				env := &storageTestEnv{
+					ctx:       context.Background(),
+					client:    client,
+					namespace: ns,
+				}
+				env.store = env.newStorage(t, tc.configure)
+				tc.test(t, env)
+			})
+		}
+	}
+}
+
+func newTestClient(id string) *DefaultClient {
+	secret, err := bcrypt.GenerateFromPassword([]byte(id+"-secret"), bcrypt.MinCost)
+	if err != nil {
+		panic(err)
+	}
+	return &DefaultClient{
+		ID:            id,
+		Secret:        secret,
+		RedirectURIs:  []string{"https://" + id + ".example.com/callback"},
+		GrantTypes:    []string{"authorization_code", "refresh_token"},
+		ResponseTypes: []string{"code"},
+		Scopes:        []string{"openid", "offline"},
+	}
+}
+
+func newTestRequest(id string, client fosite.Client, subject string) *fosite.Request {
+	return &fosite.Request{
+		ID:             id,
+		RequestedAt:    time.Now().UTC().Truncate(time.Second),
+		Client:         client,
+		RequestedScope: fosite.Arguments{"openid", "offline"},
+		GrantedScope:   fosite.Arguments{"openid", "offline"},
+		Form:           url.Values{"foo": {"bar"}},
+		Session: &openid.DefaultSession{
+			Claims:  &jwt.IDTokenClaims{Subject: subject},
+			Headers: &jwt.Headers{},
+			Subject: subject,
+		},
+	}
+}
+
+func mustCreateClient(t *testing.T, env *storageTestEnv, id string) *DefaultClient {
+	client := newTestClient(id)
+	err := env.store.CreateClient(env.ctx, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// assertRequest checks the request restored from Datastore.
+func assertRequest(t *testing.T, request fosite.Requester, id string, clientID string, subject string) {
+	t.Helper()
+
+	if request == nil {
+		t.Fatal("request is nil")
+	}
+	if v := request.GetID(); v != id {
+		t.Errorf("unexpected ID: %s", v)
+	}
+	if request.GetClient() == nil {
+		t.Fatal("client is not restored")
+	}
+	if v := request.GetClient().GetID(); v != clientID {
+		t.Errorf("unexpected client ID: %s", v)
+	}
+	if v := request.GetSession().GetSubject(); v != subject {
+		t.Errorf("unexpected subject: %s", v)
+	}
+	if v := request.GetRequestForm().Get("foo"); v != "bar" {
+		t.Errorf("unexpected form: %v", request.GetRequestForm())
+	}
+	if !request.GetGrantedScopes().Has("openid") {
+		t.Errorf("unexpected granted scopes: %v", request.GetGrantedScopes())
+	}
+}
+
+func assertNotFound(t *testing.T, err error) {
+	t.Helper()
+
+	if errors.Cause(err) != fosite.ErrNotFound {
+		t.Fatalf("fosite.ErrNotFound is expected, but: %v", err)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	runStorageTests(t, []*storageTestCase{
+		{
+			name: "CreateClient, GetClient, UpdateClient, ListClients and DeleteClient",
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+				mustCreateClient(t, env, "client-b")
+				mustCreateClient(t, env, "client-c")
+
+				err := env.store.CreateClient(env.ctx, newTestClient("client-a"))
+				if !xerrors.Is(err, ErrClientAlreadyExists) {
+					t.Fatalf("ErrClientAlreadyExists is expected, but: %v", err)
+				}
+
+				got, err := env.store.GetClient(env.ctx, "client-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v := got.GetRedirectURIs(); len(v) != 1 || v[0] != client.RedirectURIs[0] {
+					t.Errorf("unexpected redirect URIs: %v", v)
+				}
+				if bcrypt.CompareHashAndPassword(got.GetHashedSecret(), []byte("client-a-secret")) != nil {
+					t.Error("secret is not restored")
+				}
+
+				client.RedirectURIs = []string{"https://client-a.example.com/updated"}
+				err = env.store.UpdateClient(env.ctx, client)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err = env.store.GetClient(env.ctx, "client-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v := got.GetRedirectURIs(); len(v) != 1 || v[0] != "https://client-a.example.com/updated" {
+					t.Errorf("unexpected redirect URIs: %v", v)
+				}
+				err = env.store.UpdateClient(env.ctx, newTestClient("client-unknown"))
+				assertNotFound(t, err)
+
+				clients, cursor, err := env.store.ListClients(env.ctx, "", 2)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(clients) != 2 || cursor == "" {
+					t.Fatalf("unexpected first page: %d %q", len(clients), cursor)
+				}
+				clients, cursor, err = env.store.ListClients(env.ctx, cursor, 2)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(clients) != 1 || cursor != "" {
+					t.Fatalf("unexpected last page: %d %q", len(clients), cursor)
+				}
+
+				err = env.store.CreateAccessTokenSession(env.ctx, "at-a", newTestRequest("req-a", client, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.DeleteClient(env.ctx, "client-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = env.store.GetClient(env.ctx, "client-a")
+				assertNotFound(t, err)
+				_, err = env.store.GetAccessTokenSession(env.ctx, "at-a", &openid.DefaultSession{})
+				assertNotFound(t, err)
+			},
+		},
+		{
+			name: "ClientCacheStats",
+			configure: func(config *Config) {
+				cache, err := NewLRUClientCache(10, time.Minute)
+				if err != nil {
+					panic(err)
+				}
+				config.ClientCache = cache
+			},
+			test: func(t *testing.T, env *storageTestEnv) {
+				mustCreateClient(t, env, "client-a")
+
+				for i := 0; i < 3; i++ {
+					_, err := env.store.GetClient(env.ctx, "client-a")
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				stats := env.store.ClientCacheStats()
+				if stats.Hits != 2 || stats.Misses != 1 {
+					t.Errorf("unexpected stats: %+v", stats)
+				}
+			},
+		},
+		{
+			name: "ClientCache returns copies and is invalidated after commit",
+			configure: func(config *Config) {
+				cache, err := NewLRUClientCache(10, time.Minute)
+				if err != nil {
+					panic(err)
+				}
+				config.ClientCache = cache
+			},
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+				redirectURI := client.RedirectURIs[0]
+
+				got, err := env.store.GetClient(env.ctx, "client-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				got.(*DefaultClient).RedirectURIs[0] = "https://attacker.example.com/"
+				got, err = env.store.GetClient(env.ctx, "client-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v := got.GetRedirectURIs()[0]; v != redirectURI {
+					t.Fatalf("the cached client is modified: %s", v)
+				}
+
+				txCtx, err := env.store.BeginTX(env.ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				client.RedirectURIs = []string{"https://client-a.example.com/updated"}
+				err = env.store.UpdateClient(txCtx, client)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// the old client is cached again before the commit.
+				got, err = env.store.GetClient(env.ctx, "client-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v := got.GetRedirectURIs()[0]; v != redirectURI {
+					t.Fatalf("the uncommitted client is visible: %s", v)
+				}
+				err = env.store.Commit(txCtx)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got, err = env.store.GetClient(env.ctx, "client-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v := got.GetRedirectURIs()[0]; v != "https://client-a.example.com/updated" {
+					t.Fatalf("the stale client is cached: %s", v)
+				}
+
+				txCtx, err = env.store.BeginTX(env.ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.DeleteClient(txCtx, "client-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.Rollback(txCtx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = env.store.GetClient(env.ctx, "client-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "CreateAuthorizeCodeSession, GetAuthorizeCodeSession and InvalidateAuthorizeCodeSession",
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+
+				err := env.store.CreateAuthorizeCodeSession(env.ctx, "code-a", newTestRequest("req-a", client, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				request, err := env.store.GetAuthorizeCodeSession(env.ctx, "code-a", &openid.DefaultSession{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertRequest(t, request, "req-a", "client-a", "user-a")
+
+				err = env.store.InvalidateAuthorizeCodeSession(env.ctx, "code-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				request, err = env.store.GetAuthorizeCodeSession(env.ctx, "code-a", &openid.DefaultSession{})
+				if errors.Cause(err) != fosite.ErrInvalidatedAuthorizeCode {
+					t.Fatalf("fosite.ErrInvalidatedAuthorizeCode is expected, but: %v", err)
+				}
+				// fosite revokes the tokens issued by the request ID.
+				if request == nil || request.GetID() != "req-a" {
+					t.Errorf("unexpected request: %+v", request)
+				}
+
+				_, err = env.store.GetAuthorizeCodeSession(env.ctx, "code-unknown", &openid.DefaultSession{})
+				assertNotFound(t, err)
+			},
+		},
+		{
+			name: "CreateAccessTokenSession, GetAccessTokenSession and DeleteAccessTokenSession",
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+
+				err := env.store.CreateAccessTokenSession(env.ctx, "at-a", newTestRequest("req-a", client, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				request, err := env.store.GetAccessTokenSession(env.ctx, "at-a", &openid.DefaultSession{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertRequest(t, request, "req-a", "client-a", "user-a")
+
+				err = env.store.DeleteAccessTokenSession(env.ctx, "at-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = env.store.GetAccessTokenSession(env.ctx, "at-a", &openid.DefaultSession{})
+				assertNotFound(t, err)
+			},
+		},
+		{
+			name: "refresh token rotation and reuse",
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+				request := newTestRequest("req-a", client, "user-a")
+
+				err := env.store.CreateAccessTokenSession(env.ctx, "at-a", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreateRefreshTokenSession(env.ctx, "rt-a", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := env.store.GetRefreshTokenSession(env.ctx, "rt-a", &openid.DefaultSession{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertRequest(t, got, "req-a", "client-a", "user-a")
+
+				// rotate.
+				err = env.store.DeleteRefreshTokenSession(env.ctx, "rt-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreateRefreshTokenSession(env.ctx, "rt-b", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// reuse of the rotated token revokes the family.
+				_, err = env.store.GetRefreshTokenSession(env.ctx, "rt-a", &openid.DefaultSession{})
+				assertNotFound(t, err)
+				if !xerrors.Is(err, ErrRefreshTokenReused) {
+					t.Errorf("ErrRefreshTokenReused is expected, but: %v", err)
+				}
+				_, err = env.store.GetAccessTokenSession(env.ctx, "at-a", &openid.DefaultSession{})
+				assertNotFound(t, err)
+				_, err = env.store.GetRefreshTokenSession(env.ctx, "rt-b", &openid.DefaultSession{})
+				if !xerrors.Is(err, ErrRefreshTokenReused) {
+					t.Errorf("ErrRefreshTokenReused is expected, but: %v", err)
+				}
+			},
+		},
+		{
+			name: "RevokeAccessToken and RevokeRefreshToken",
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+				request := newTestRequest("req-a", client, "user-a")
+
+				for _, sig := range []string{"at-a", "at-b"} {
+					err := env.store.CreateAccessTokenSession(env.ctx, sig, request)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				err := env.store.RevokeAccessToken(env.ctx, "req-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, sig := range []string{"at-a", "at-b"} {
+					_, err := env.store.GetAccessTokenSession(env.ctx, sig, &openid.DefaultSession{})
+					assertNotFound(t, err)
+				}
+
+				err = env.store.CreateAccessTokenSession(env.ctx, "at-c", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreateRefreshTokenSession(env.ctx, "rt-a", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.RevokeRefreshToken(env.ctx, "req-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = env.store.GetAccessTokenSession(env.ctx, "at-c", &openid.DefaultSession{})
+				assertNotFound(t, err)
+				_, err = env.store.GetRefreshTokenSession(env.ctx, "rt-a", &openid.DefaultSession{})
+				assertNotFound(t, err)
+			},
+		},
+		{
+			name: "CreateOpenIDConnectSession, GetOpenIDConnectSession and DeleteOpenIDConnectSession",
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+				request := newTestRequest("req-a", client, "user-a")
+				request.Form.Set("nonce", "nonce-a")
+
+				err := env.store.CreateOpenIDConnectSession(env.ctx, "code-a", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := env.store.GetOpenIDConnectSession(env.ctx, "code-a", &fosite.Request{Session: &openid.DefaultSession{}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertRequest(t, got, "req-a", "client-a", "user-a")
+
+				err = env.store.DeleteOpenIDConnectSession(env.ctx, "code-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = env.store.GetOpenIDConnectSession(env.ctx, "code-a", &fosite.Request{Session: &openid.DefaultSession{}})
+				if errors.Cause(err) != fosite.ErrInvalidatedAuthorizeCode {
+					t.Fatalf("fosite.ErrInvalidatedAuthorizeCode is expected, but: %v", err)
+				}
+
+				// refreshes of the grant retain the inactive session.
+				err = env.store.RevokeRefreshToken(env.ctx, "req-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = env.store.GetOpenIDConnectSession(env.ctx, "code-a", &fosite.Request{Session: &openid.DefaultSession{}})
+				if errors.Cause(err) != fosite.ErrInvalidatedAuthorizeCode {
+					t.Fatalf("the session is deleted by RevokeRefreshToken: %v", err)
+				}
+			},
+		},
+		{
+			name: "CreatePKCERequestSession, GetPKCERequestSession and DeletePKCERequestSession",
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+
+				err := env.store.CreatePKCERequestSession(env.ctx, "code-a", newTestRequest("req-a", client, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := env.store.GetPKCERequestSession(env.ctx, "code-a", &openid.DefaultSession{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertRequest(t, got, "req-a", "client-a", "user-a")
+
+				err = env.store.DeletePKCERequestSession(env.ctx, "code-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = env.store.GetPKCERequestSession(env.ctx, "code-a", &openid.DefaultSession{})
+				assertNotFound(t, err)
+			},
+		},
+		{
+			name: "Authenticate by Config.AuthenticateUser",
+			configure: func(config *Config) {
+				config.AuthenticateUser = func(ctx context.Context, name, secret string) error {
+					if name == "user-a" && secret == "pass-a" {
+						return nil
+					}
+					return fosite.ErrNotFound
+				}
+			},
+			test: func(t *testing.T, env *storageTestEnv) {
+				err := env.store.Authenticate(env.ctx, "user-a", "pass-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.Authenticate(env.ctx, "user-a", "wrong")
+				assertNotFound(t, err)
+			},
+		},
+		{
+			name: "CreateUser, UpdateUserPassword, UnlockUser, DeleteUser and Authenticate by the user store",
+			configure: func(config *Config) {
+				config.UseUserStore = true
+				config.UserStoreOptions = &UserStoreOptions{
+					Hasher: &BCryptHasher{Cost: bcrypt.MinCost},
+				}
+			},
+			test: func(t *testing.T, env *storageTestEnv) {
+				err := env.store.CreateUser(env.ctx, "user-a", "pass-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreateUser(env.ctx, "user-a", "pass-b")
+				if !xerrors.Is(err, ErrUserAlreadyExists) {
+					t.Fatalf("ErrUserAlreadyExists is expected, but: %v", err)
+				}
+
+				err = env.store.Authenticate(env.ctx, "user-a", "pass-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.Authenticate(env.ctx, "user-a", "wrong")
+				assertNotFound(t, err)
+				err = env.store.Authenticate(env.ctx, "user-unknown", "pass-a")
+				assertNotFound(t, err)
+
+				err = env.store.UpdateUserPassword(env.ctx, "user-a", "pass-b")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.Authenticate(env.ctx, "user-a", "pass-b")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.UnlockUser(env.ctx, "user-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				err = env.store.DeleteUser(env.ctx, "user-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.Authenticate(env.ctx, "user-a", "pass-b")
+				assertNotFound(t, err)
+				err = env.store.UnlockUser(env.ctx, "user-a")
+				assertNotFound(t, err)
+			},
+		},
+		{
+			name: "Authenticate locks the user out after consecutive failures",
+			configure: func(config *Config) {
+				config.UseUserStore = true
+				config.UserStoreOptions = &UserStoreOptions{
+					Hasher:            &BCryptHasher{Cost: bcrypt.MinCost},
+					MaxFailedAttempts: 2,
+				}
+			},
+			test: func(t *testing.T, env *storageTestEnv) {
+				err := env.store.CreateUser(env.ctx, "user-a", "pass-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for i := 0; i < 2; i++ {
+					err = env.store.Authenticate(env.ctx, "user-a", "wrong")
+					assertNotFound(t, err)
+					if xerrors.Is(err, ErrUserLocked) {
+						t.Fatalf("the user is locked out too early: %d", i)
+					}
+				}
+
+				// the locked user is not found for fosite, even with the right password.
+				err = env.store.Authenticate(env.ctx, "user-a", "pass-a")
+				assertNotFound(t, err)
+				if !xerrors.Is(err, ErrUserLocked) {
+					t.Fatalf("ErrUserLocked is expected, but: %v", err)
+				}
+
+				err = env.store.UnlockUser(env.ctx, "user-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.Authenticate(env.ctx, "user-a", "pass-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "Authenticate by the custom PasswordHasher",
+			configure: func(config *Config) {
+				config.UseUserStore = true
+				config.UserStoreOptions = &UserStoreOptions{
+					Hasher: &BCryptHasher{Cost: bcrypt.MinCost},
+				}
+			},
+			test: func(t *testing.T, env *storageTestEnv) {
+				err := env.store.CreateUser(env.ctx, "user-a", "pass-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				hasher := &prefixHasher{Prefix: "prefix:"}
+				custom := env.newStorage(t, func(config *Config) {
+					config.UseUserStore = true
+					config.UserStoreOptions = &UserStoreOptions{Hasher: hasher}
+				})
+				err = custom.CreateUser(env.ctx, "user-b", "pass-b")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// the bcrypt hash is verified after the hasher is changed.
+				err = custom.Authenticate(env.ctx, "user-a", "pass-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = custom.Authenticate(env.ctx, "user-b", "pass-b")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = custom.Authenticate(env.ctx, "user-b", "wrong")
+				assertNotFound(t, err)
+
+				// the unknown user is compared by the hasher too.
+				compares := hasher.Compares
+				err = custom.Authenticate(env.ctx, "user-unknown", "pass-b")
+				assertNotFound(t, err)
+				if hasher.Compares != compares+1 {
+					t.Errorf("the dummy hash isn't compared by the hasher: %d", hasher.Compares-compares)
+				}
+
+				// the broken hash fails as a wrong password, not as the server error.
+				s := env.store.(*datastoreStorage)
+				acc, err := s.accessor(env.ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = acc.Put(s.userKey(acc, "user-c"), &User{
+					PasswordHash: "$argon2id$v=19$m=65536,t=1,p=0$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = custom.Authenticate(env.ctx, "user-c", "pass-c")
+				assertNotFound(t, err)
+			},
+		},
+		{
+			name: "BeginTX, Commit and Rollback",
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+
+				txCtx, err := env.store.BeginTX(env.ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreateAccessTokenSession(txCtx, "at-a", newTestRequest("req-a", client, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.Rollback(txCtx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = env.store.GetAccessTokenSession(env.ctx, "at-a", &openid.DefaultSession{})
+				assertNotFound(t, err)
+
+				txCtx, err = env.store.BeginTX(env.ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreateAccessTokenSession(txCtx, "at-a", newTestRequest("req-a", client, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.Commit(txCtx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = env.store.GetAccessTokenSession(env.ctx, "at-a", &openid.DefaultSession{})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				err = env.store.Commit(txCtx)
+				if err == nil {
+					t.Error("the second Commit must fail")
+				}
+			},
+		},
+		{
+			name: "RunInTransaction",
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+
+				errAbort := xerrors.New("abort")
+				err := env.store.RunInTransaction(env.ctx, func(ctx context.Context) error {
+					err := env.store.CreateAccessTokenSession(ctx, "at-a", newTestRequest("req-a", client, "user-a"))
+					if err != nil {
+						return err
+					}
+					return errAbort
+				})
+				if err != errAbort {
+					t.Fatalf("errAbort is expected, but: %v", err)
+				}
+				_, err = env.store.GetAccessTokenSession(env.ctx, "at-a", &openid.DefaultSession{})
+				assertNotFound(t, err)
+
+				err = env.store.RunInTransaction(env.ctx, func(ctx context.Context) error {
+					return env.store.CreateAccessTokenSession(ctx, "at-a", newTestRequest("req-a", client, "user-a"))
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = env.store.GetAccessTokenSession(env.ctx, "at-a", &openid.DefaultSession{})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "finished transaction context",
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+
+				for _, finish := range []func(ctx context.Context) error{env.store.Commit, env.store.Rollback} {
+					txCtx, err := env.store.BeginTX(env.ctx)
+					if err != nil {
+						t.Fatal(err)
+					}
+					err = finish(txCtx)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					err = env.store.CreateAccessTokenSession(txCtx, "at-a", newTestRequest("req-a", client, "user-a"))
+					if errors.Cause(err) != errFinishedTxContext {
+						t.Fatalf("errFinishedTxContext is expected, but: %v", err)
+					}
+					_, err = env.store.GetClient(txCtx, "client-a")
+					if errors.Cause(err) != errFinishedTxContext {
+						t.Fatalf("errFinishedTxContext is expected, but: %v", err)
+					}
+				}
+				_, err := env.store.GetAccessTokenSession(env.ctx, "at-a", &openid.DefaultSession{})
+				assertNotFound(t, err)
+			},
+		},
+		{
+			name: "Rollback of the joined context",
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+
+				outerCtx, err := env.store.BeginTX(env.ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreateAccessTokenSession(outerCtx, "at-a", newTestRequest("req-a", client, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				innerCtx, err := env.store.BeginTX(outerCtx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreateAccessTokenSession(innerCtx, "at-b", newTestRequest("req-b", client, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.Rollback(innerCtx)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// the outer transaction is still usable, but it can't be committed.
+				err = env.store.CreateAccessTokenSession(outerCtx, "at-c", newTestRequest("req-c", client, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.Commit(outerCtx)
+				if errors.Cause(err) != errTxRollbackOnly {
+					t.Fatalf("errTxRollbackOnly is expected, but: %v", err)
+				}
+				for _, sig := range []string{"at-a", "at-b", "at-c"} {
+					_, err := env.store.GetAccessTokenSession(env.ctx, sig, &openid.DefaultSession{})
+					assertNotFound(t, err)
+				}
+
+				// Commit of the joined context is left to the outer one.
+				outerCtx, err = env.store.BeginTX(env.ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				innerCtx, err = env.store.BeginTX(outerCtx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreateAccessTokenSession(innerCtx, "at-d", newTestRequest("req-d", client, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.Commit(innerCtx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.Commit(outerCtx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = env.store.GetAccessTokenSession(env.ctx, "at-d", &openid.DefaultSession{})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "PurgeExpired",
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+
+				expired := newTestRequest("req-a", client, "user-a")
+				expired.Session.(*openid.DefaultSession).ExpiresAt = map[fosite.TokenType]time.Time{
+					fosite.AccessToken: time.Now().Add(-time.Hour),
+				}
+				err := env.store.CreateAccessTokenSession(env.ctx, "at-a", expired)
+				if err != nil {
+					t.Fatal(err)
+				}
+				live := newTestRequest("req-b", client, "user-a")
+				live.Session.(*openid.DefaultSession).ExpiresAt = map[fosite.TokenType]time.Time{
+					fosite.AccessToken: time.Now().Add(time.Hour),
+				}
+				err = env.store.CreateAccessTokenSession(env.ctx, "at-b", live)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreateAccessTokenSession(env.ctx, "at-c", newTestRequest("req-c", client, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				_, err = env.store.GetAccessTokenSession(env.ctx, "at-a", &openid.DefaultSession{})
+				assertNotFound(t, err)
+
+				counts, err := env.store.PurgeExpired(env.ctx, time.Now(), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s := env.store.(*datastoreStorage)
+				if v := counts[s.AccessTokenKind]; v != 1 {
+					t.Errorf("unexpected count: %d", v)
+				}
+				for _, sig := range []string{"at-b", "at-c"} {
+					_, err := env.store.GetAccessTokenSession(env.ctx, sig, &openid.DefaultSession{})
+					if err != nil {
+						t.Errorf("%s: %v", sig, err)
+					}
+				}
+			},
+		},
+		{
+			name: "PurgeExpired in batches",
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+				for i := 0; i < 5; i++ {
+					request := newTestRequest(fmt.Sprintf("req-%d", i), client, "user-a")
+					request.Session.(*openid.DefaultSession).ExpiresAt = map[fosite.TokenType]time.Time{
+						fosite.AccessToken: time.Now().Add(-time.Hour),
+					}
+					err := env.store.CreateAccessTokenSession(env.ctx, fmt.Sprintf("at-%d", i), request)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				s := env.store.(*datastoreStorage)
+				acc, err := s.accessor(env.ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = acc.Put(acc.NameKey(s.JWKSCacheKind, "https://client-a.example.com/jwks.json", nil), &jwksCacheEntry{
+					KeySetJSON: `{"keys":[]}`,
+					ExpiresAt:  time.Now().Add(-time.Hour),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				counts, err := env.store.PurgeExpired(env.ctx, time.Now(), &PurgeOptions{BatchSize: 2})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v := counts[s.AccessTokenKind]; v != 5 {
+					t.Errorf("unexpected count: %d", v)
+				}
+				if v := counts[s.JWKSCacheKind]; v != 1 {
+					t.Errorf("unexpected count of the JWKS cache: %d", v)
+				}
+			},
+		},
+		{
+			name: "ListGrantsBySubject with the custom requester",
+			configure: func(config *Config) {
+				config.NewRequester = func() fosite.Requester {
+					return &taggedRequester{}
+				}
+			},
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+				request := &taggedRequester{Tag: "tag-a"}
+				request.ID = "req-a"
+				request.RequestedAt = time.Now().UTC().Truncate(time.Second)
+				request.Client = client
+				request.GrantedScope = []string{"openid"}
+				request.Active = true
+				request.Session = newTestRequest("req-a", client, "user-a").Session
+				err := env.store.CreateAccessTokenSession(env.ctx, "at-a", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				grants, err := env.store.ListGrantsBySubject(env.ctx, "user-a", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(grants) != 1 || grants[0].RequestID != "req-a" || grants[0].ClientID != "client-a" {
+					t.Fatalf("unexpected grants: %+v", grants)
+				}
+			},
+		},
+		{
+			name: "ListGrantsBySubject and RevokeAllForSubject",
+			test: func(t *testing.T, env *storageTestEnv) {
+				clientA := mustCreateClient(t, env, "client-a")
+				clientB := mustCreateClient(t, env, "client-b")
+
+				err := env.store.CreateAccessTokenSession(env.ctx, "at-a", newTestRequest("req-a", clientA, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreateRefreshTokenSession(env.ctx, "rt-a", newTestRequest("req-a", clientA, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreateAccessTokenSession(env.ctx, "at-b", newTestRequest("req-b", clientB, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreateAccessTokenSession(env.ctx, "at-c", newTestRequest("req-c", clientA, "user-b"))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				grants, err := env.store.ListGrantsBySubject(env.ctx, "user-a", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(grants) != 2 {
+					t.Fatalf("unexpected grants: %d", len(grants))
+				}
+				grants, err = env.store.ListGrantsBySubject(env.ctx, "user-a", &GrantOptions{ClientID: "client-b"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(grants) != 1 || grants[0].RequestID != "req-b" {
+					t.Fatalf("unexpected grants: %+v", grants)
+				}
+
+				err = env.store.RevokeAllForSubject(env.ctx, "user-a", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, sig := range []string{"at-a", "at-b"} {
+					_, err := env.store.GetAccessTokenSession(env.ctx, sig, &openid.DefaultSession{})
+					assertNotFound(t, err)
+				}
+				_, err = env.store.GetAccessTokenSession(env.ctx, "at-c", &openid.DefaultSession{})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "MigrateRequestKeys",
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+
+				err := env.store.CreateAccessTokenSession(env.ctx, "at-a", newTestRequest("req-a", client, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				_, err = env.store.MigrateRequestKeys(env.ctx, nil)
+				if err == nil {
+					t.Fatal("MigrateRequestKeys requires KeyNameDeriver")
+				}
+
+				deriver := &HMACKeyNameDeriver{
+					Keys:             []*HMACKey{{ID: "k1", Secret: []byte("secret")}},
+					FallbackToRawKey: true,
+				}
+				derived := env.newStorage(t, func(config *Config) {
+					config.KeyNameDeriver = deriver
+				})
+				counts, err := derived.MigrateRequestKeys(env.ctx, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s := env.store.(*datastoreStorage)
+				if v := counts[s.AccessTokenKind]; v != 1 {
+					t.Errorf("unexpected count: %d", v)
+				}
+
+				deriver.FallbackToRawKey = false
+				request, err := derived.GetAccessTokenSession(env.ctx, "at-a", &openid.DefaultSession{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertRequest(t, request, "req-a", "client-a", "user-a")
+				_, err = env.store.GetAccessTokenSession(env.ctx, "at-a", &openid.DefaultSession{})
+				assertNotFound(t, err)
+			},
+		},
+		{
+			name: "MigrateRequestKeys skips names of the dropped keys",
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+
+				k1 := &HMACKey{ID: "k1", Secret: []byte("secret-1")}
+				k2 := &HMACKey{ID: "k2", Secret: []byte("secret-2")}
+				old := env.newStorage(t, func(config *Config) {
+					config.KeyNameDeriver = &HMACKeyNameDeriver{Keys: []*HMACKey{k1}}
+				})
+				err := old.CreateAccessTokenSession(env.ctx, "at-a", newTestRequest("req-a", client, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// k1 is dropped, the name derived by k1 must not be derived again as the raw value.
+				derived := env.newStorage(t, func(config *Config) {
+					config.KeyNameDeriver = &HMACKeyNameDeriver{
+						Keys:             []*HMACKey{k2},
+						FallbackToRawKey: true,
+					}
+				})
+				counts, err := derived.MigrateRequestKeys(env.ctx, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s := env.store.(*datastoreStorage)
+				if v := counts[s.AccessTokenKind]; v != 0 {
+					t.Errorf("unexpected count: %d", v)
+				}
+
+				_, err = old.GetAccessTokenSession(env.ctx, "at-a", &openid.DefaultSession{})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "GetMultiRequesters",
+			test: func(t *testing.T, env *storageTestEnv) {
+				clientA := mustCreateClient(t, env, "client-a")
+				clientB := mustCreateClient(t, env, "client-b")
+
+				err := env.store.CreateAccessTokenSession(env.ctx, "at-a", newTestRequest("req-a", clientA, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreateAccessTokenSession(env.ctx, "at-b", newTestRequest("req-b", clientB, "user-b"))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// the request without the client.
+				noClient := newTestRequest("req-c", nil, "user-c")
+				err = env.store.CreateAccessTokenSession(env.ctx, "at-c", noClient)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				s := env.store.(*datastoreStorage)
+				requests, err := env.store.GetMultiRequesters(env.ctx, s.AccessTokenKind, []string{"at-a", "at-unknown", "at-b", "at-c"})
+				merr, ok := err.(MultiError)
+				if !ok {
+					t.Fatalf("MultiError is expected, but: %v", err)
+				}
+				if merr[0] != nil || merr[2] != nil || merr[3] != nil {
+					t.Fatalf("unexpected errors: %v", merr)
+				}
+				assertNotFound(t, merr[1])
+				assertRequest(t, requests[0], "req-a", "client-a", "user-a")
+				assertRequest(t, requests[2], "req-b", "client-b", "user-b")
+				if v := requests[3].GetClient(); v != nil {
+					t.Errorf("unexpected client: %+v", v)
+				}
+			},
+		},
+		{
+			name: "RevokeTokensByAuthorizeCode",
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+				request := newTestRequest("req-a", client, "user-a")
+
+				err := env.store.CreateAuthorizeCodeSession(env.ctx, "code-a", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreateAccessTokenSession(env.ctx, "at-a", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreateRefreshTokenSession(env.ctx, "rt-a", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// the tokens refreshed from rt-a take over the request ID.
+				err = env.store.CreateAccessTokenSession(env.ctx, "at-b", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// the token of another grant.
+				err = env.store.CreateAccessTokenSession(env.ctx, "at-c", newTestRequest("req-c", client, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// the code isn't used yet.
+				err = env.store.RevokeTokensByAuthorizeCode(env.ctx, "code-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = env.store.GetAccessTokenSession(env.ctx, "at-a", &openid.DefaultSession{})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				err = env.store.InvalidateAuthorizeCodeSession(env.ctx, "code-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.RevokeTokensByAuthorizeCode(env.ctx, "code-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, sig := range []string{"at-a", "at-b"} {
+					_, err = env.store.GetAccessTokenSession(env.ctx, sig, &openid.DefaultSession{})
+					assertNotFound(t, err)
+				}
+				_, err = env.store.GetRefreshTokenSession(env.ctx, "rt-a", &openid.DefaultSession{})
+				assertNotFound(t, err)
+				_, err = env.store.GetAccessTokenSession(env.ctx, "at-c", &openid.DefaultSession{})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				err = env.store.RevokeTokensByAuthorizeCode(env.ctx, "code-unknown")
+				assertNotFound(t, err)
+			},
+		},
+		{
+			name: "MigrateRequestKeys in batches",
+			configure: func(config *Config) {
+				config.KeyLayout = RequestAncestorKeyLayout
+			},
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+
+				for _, sig := range []string{"at-a", "at-b", "at-c"} {
+					err := env.store.CreateAccessTokenSession(env.ctx, sig, newTestRequest("req-a", client, "user-a"))
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				err := env.store.CreateAuthorizeCodeSession(env.ctx, "code-a", newTestRequest("req-a", client, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				derived := env.newStorage(t, func(config *Config) {
+					config.KeyLayout = RequestAncestorKeyLayout
+					config.KeyNameDeriver = &HMACKeyNameDeriver{
+						Keys:             []*HMACKey{{ID: "k1", Secret: []byte("secret")}},
+						FallbackToRawKey: true,
+					}
+				})
+				// the code is used after the deriver is enabled, the derived entity is newer than the raw one.
+				err = derived.CreateAuthorizeCodeSession(env.ctx, "code-a", newTestRequest("req-a", client, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = derived.InvalidateAuthorizeCodeSession(env.ctx, "code-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				s := env.store.(*datastoreStorage)
+				cursors := make(map[string]string)
+				var batches int
+				counts, err := derived.MigrateRequestKeys(env.ctx, &MigrateKeysOptions{
+					Kinds:     []string{s.AccessTokenKind, s.AuthorizeCodeKind},
+					BatchSize: 1,
+					Progress: func(kind string, cursor string, migrated int) {
+						batches++
+						cursors[kind] = cursor
+					},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v := counts[s.AccessTokenKind]; v != 3 {
+					t.Errorf("unexpected count: %d", v)
+				}
+				if v := counts[s.AuthorizeCodeKind]; v != 0 {
+					t.Errorf("the derived entity is overwritten: %d", v)
+				}
+				if batches < 4 {
+					t.Errorf("unexpected batches: %d", batches)
+				}
+				_, err = derived.GetAuthorizeCodeSession(env.ctx, "code-a", &openid.DefaultSession{})
+				if errors.Cause(err) != fosite.ErrInvalidatedAuthorizeCode {
+					t.Fatalf("the invalidation is overwritten: %v", err)
+				}
+
+				// resume from the saved cursors.
+				counts, err = derived.MigrateRequestKeys(env.ctx, &MigrateKeysOptions{
+					Kinds:   []string{s.AccessTokenKind, s.AuthorizeCodeKind},
+					Cursors: cursors,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v := counts[s.AccessTokenKind]; v != 0 {
+					t.Errorf("unexpected count of the resumed run: %d", v)
+				}
+
+				// the group members follow the derived names.
+				err = derived.RevokeAccessToken(env.ctx, "req-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, sig := range []string{"at-a", "at-b", "at-c"} {
+					_, err := derived.GetAccessTokenSession(env.ctx, sig, &openid.DefaultSession{})
+					assertNotFound(t, err)
+				}
+			},
+		},
+		{
+			name: "MigrateSchema",
+			test: func(t *testing.T, env *storageTestEnv) {
+				mustCreateClient(t, env, "client-a")
+
+				// the access token stored before SchemaVersion is added.
+				s := env.store.(*datastoreStorage)
+				acc, err := s.accessor(env.ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = acc.Put(acc.NameKey(s.AccessTokenKind, "at-a", nil), &datastore.PropertyList{
+					{Name: "ID", Value: "req-a"},
+					{Name: "ClientID", Value: "client-a"},
+					{Name: "RequestedAt", Value: time.Now()},
+					{Name: "Active", Value: true},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var progress int
+				counts, err := env.store.MigrateSchema(env.ctx, &MigrateSchemaOptions{
+					Kinds: []string{s.AccessTokenKind},
+					Progress: func(kind string, cursor string, migrated int) {
+						progress++
+					},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v := counts[s.AccessTokenKind]; v != 1 {
+					t.Errorf("unexpected count: %d", v)
+				}
+				if progress == 0 {
+					t.Error("Progress is not called")
+				}
+
+				var ps datastore.PropertyList
+				err = acc.Get(acc.NameKey(s.AccessTokenKind, "at-a", nil), &ps)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v := schemaVersionOf(ps); v != requesterSchemaVersion {
+					t.Errorf("unexpected schema version: %d", v)
+				}
+
+				counts, err = env.store.MigrateSchema(env.ctx, &MigrateSchemaOptions{
+					Kinds: []string{s.AccessTokenKind},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v := counts[s.AccessTokenKind]; v != 0 {
+					t.Errorf("unexpected count of the second run: %d", v)
+				}
+			},
+		},
+		{
+			name: "MigrateSchema doesn't overwrite the concurrent write",
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+
+				err := env.store.CreateAuthorizeCodeSession(env.ctx, "code-a", newTestRequest("req-a", client, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				s := env.store.(*datastoreStorage)
+				acc, err := s.accessor(env.ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				key := acc.NameKey(s.AuthorizeCodeKind, "code-a", nil)
+
+				// MigrateSchema found the old entity, and then the code is used.
+				err = env.store.InvalidateAuthorizeCodeSession(env.ctx, "code-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				migrated, err := s.migrateSchemaEntity(acc.NoTx(), s.AuthorizeCodeKind, key, requesterSchemaVersion+1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !migrated {
+					t.Fatal("the entity isn't migrated")
+				}
+				migrated, err = s.migrateSchemaEntity(acc.NoTx(), s.AuthorizeCodeKind, key, requesterSchemaVersion)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if migrated {
+					t.Error("the entity of the latest version is rewritten")
+				}
+
+				_, err = env.store.GetAuthorizeCodeSession(env.ctx, "code-a", &openid.DefaultSession{})
+				if errors.Cause(err) != fosite.ErrInvalidatedAuthorizeCode {
+					t.Fatalf("the invalidation is overwritten: %v", err)
+				}
+			},
+		},
+		{
+			name: "ClientAuthHasher limits failures of the client authentication",
+			configure: func(config *Config) {
+				config.RateLimiter = &RateLimiterOptions{
+					Client: &RateLimitPolicy{Limit: 2, Window: time.Minute},
+				}
+			},
+			test: func(t *testing.T, env *storageTestEnv) {
+				mustCreateClient(t, env, "client-a")
+				mustCreateClient(t, env, "client-b")
+				hasher := &ClientAuthHasher{
+					Storage: env.store,
+					Hasher:  &fosite.BCrypt{WorkFactor: bcrypt.MinCost},
+				}
+
+				compare := func(clientID string, secret string) error {
+					ctx := WithClientAuthentication(env.ctx)
+					client, err := env.store.GetClient(ctx, clientID)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return hasher.Compare(ctx, client.GetHashedSecret(), []byte(secret))
+				}
+
+				for i := 0; i < 2; i++ {
+					err := compare("client-a", "wrong")
+					if err == nil || xerrors.Is(err, ErrRateLimited) {
+						t.Fatalf("the mismatch is expected, but: %v", err)
+					}
+				}
+
+				// GetClient is not limited, the right secret is rejected.
+				err := compare("client-a", "client-a-secret")
+				if !xerrors.Is(err, ErrRateLimited) {
+					t.Fatalf("ErrRateLimited is expected, but: %v", err)
+				}
+				err = compare("client-b", "client-b-secret")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				counts, err := env.store.PurgeExpired(env.ctx, time.Now().Add(2*time.Minute), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if counts["FositeRateLimit"] == 0 {
+					t.Fatalf("counters of the rate limit are not purged: %v", counts)
+				}
+				err = compare("client-a", "client-a-secret")
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "Authenticate reports ErrRateLimited as fosite.ErrNotFound",
+			configure: func(config *Config) {
+				config.AuthenticateUser = func(ctx context.Context, name, secret string) error {
+					return fosite.ErrNotFound
+				}
+				config.RateLimiter = &RateLimiterOptions{
+					User: &RateLimitPolicy{Limit: 1, Window: time.Minute},
+				}
+			},
+			test: func(t *testing.T, env *storageTestEnv) {
+				err := env.store.Authenticate(env.ctx, "user-a", "wrong")
+				assertNotFound(t, err)
+				if xerrors.Is(err, ErrRateLimited) {
+					t.Fatalf("the user is limited too early: %v", err)
+				}
+
+				err = env.store.Authenticate(env.ctx, "user-a", "wrong")
+				assertNotFound(t, err)
+				if !xerrors.Is(err, ErrRateLimited) {
+					t.Fatalf("ErrRateLimited is expected, but: %v", err)
+				}
+			},
+		},
+		{
+			name: "RotateClientSecret",
+			test: func(t *testing.T, env *storageTestEnv) {
+				mustCreateClient(t, env, "client-a")
+
+				newHash, err := bcrypt.GenerateFromPassword([]byte("new-secret"), bcrypt.MinCost)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.RotateClientSecret(env.ctx, "client-a", newHash, time.Hour)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.RotateClientSecret(env.ctx, "client-unknown", newHash, time.Hour)
+				assertNotFound(t, err)
+
+				client, err := env.store.GetClient(env.ctx, "client-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, secret := range []string{"new-secret", "client-a-secret"} {
+					err := AuthenticateClientSecret(client, []byte(secret), bcrypt.CompareHashAndPassword)
+					if err != nil {
+						t.Errorf("%s: %v", secret, err)
+					}
+				}
+				err = AuthenticateClientSecret(client, []byte("wrong"), bcrypt.CompareHashAndPassword)
+				if err == nil {
+					t.Error("wrong secret is accepted")
+				}
+			},
+		},
+		{
+			name: "ClientAuthHasher accepts rotated secrets in fosite's client authentication",
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := newTestClient("client-a")
+				client.TokenEndpointAuthMethod = "client_secret_basic"
+				err := env.store.CreateClient(env.ctx, client)
+				if err != nil {
+					t.Fatal(err)
+				}
+				newHash, err := bcrypt.GenerateFromPassword([]byte("new-secret"), bcrypt.MinCost)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.RotateClientSecret(env.ctx, "client-a", newHash, time.Hour)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				f := &fosite.Fosite{
+					Store:  env.store,
+					Hasher: &ClientAuthHasher{Storage: env.store, Hasher: &fosite.BCrypt{WorkFactor: bcrypt.MinCost}},
+				}
+				authenticate := func(secret string) error {
+					r := httptest.NewRequest(http.MethodPost, "/token", nil)
+					r.SetBasicAuth("client-a", secret)
+					_, err := f.AuthenticateClient(WithClientAuthentication(env.ctx), r, url.Values{})
+					return err
+				}
+				for _, secret := range []string{"new-secret", "client-a-secret"} {
+					err := authenticate(secret)
+					if err != nil {
+						t.Errorf("%s: %v", secret, err)
+					}
+				}
+				err = authenticate("wrong")
+				if fosite.ErrorToRFC6749Error(err).Name != fosite.ErrInvalidClient.Name {
+					t.Errorf("fosite.ErrInvalidClient is expected, but: %v", err)
+				}
+			},
+		},
+		{
+			name: "RotateClientSecret rejects the grace period for clients without rotated secrets",
+			configure: func(config *Config) {
+				config.NewClientEntity = func() fosite.Client {
+					return &fosite.DefaultClient{}
+				}
+			},
+			test: func(t *testing.T, env *storageTestEnv) {
+				mustCreateClient(t, env, "client-a")
+				newHash, err := bcrypt.GenerateFromPassword([]byte("new-secret"), bcrypt.MinCost)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				err = env.store.RotateClientSecret(env.ctx, "client-a", newHash, time.Hour)
+				if err != errClientNeedsRotatedSecrets {
+					t.Fatalf("errClientNeedsRotatedSecrets is expected, but: %v", err)
+				}
+				err = env.store.RotateClientSecret(env.ctx, "client-a", newHash, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				client, err := env.store.GetClient(env.ctx, "client-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = bcrypt.CompareHashAndPassword(client.GetHashedSecret(), []byte("new-secret"))
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "ResolveJSONWebKeys and JWKSFetcherStrategy",
+			test: func(t *testing.T, env *storageTestEnv) {
+				jwks := newTestJSONWebKeySet(t, "key-1")
+				var fetches, notModified int32
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					atomic.AddInt32(&fetches, 1)
+					b, err := json.Marshal(jwks)
+					if err != nil {
+						t.Error(err)
+					}
+					etag := fmt.Sprintf(`"%d"`, len(jwks.Keys))
+					if r.Header.Get("If-None-Match") == etag {
+						atomic.AddInt32(&notModified, 1)
+						w.WriteHeader(http.StatusNotModified)
+						return
+					}
+					w.Header().Set("ETag", etag)
+					w.Header().Set("Content-Type", "application/json")
+					_, _ = w.Write(b)
+				}))
+				defer server.Close()
+
+				got, err := env.store.ResolveJSONWebKeys(env.ctx, server.URL, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got.Key("key-1")) != 1 {
+					t.Fatalf("unexpected keys: %+v", got)
+				}
+				_, err = env.store.ResolveJSONWebKeys(env.ctx, server.URL, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v := atomic.LoadInt32(&fetches); v != 1 {
+					t.Errorf("the cached key set must be used: %d", v)
+				}
+
+				// the client starts to sign by the new key, fosite resolves it again by ignoreCache.
+				jwks.Keys = append(jwks.Keys, newTestJSONWebKeySet(t, "key-2").Keys...)
+				s := env.store.(*datastoreStorage)
+				s.jwksResolverOptions.MinRefreshInterval = 0
+				strategy := env.store.JWKSFetcherStrategy(env.ctx)
+				got, err = strategy.Resolve(server.URL, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got.Key("key-2")) != 1 {
+					t.Fatalf("the key set must be refreshed on the unknown key ID: %+v", got)
+				}
+
+				got, err = strategy.Resolve(server.URL, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got.Keys) != 2 {
+					t.Fatalf("unexpected keys: %+v", got)
+				}
+				if v := atomic.LoadInt32(&notModified); v != 1 {
+					t.Errorf("the cached key set must be revalidated by ETag: %d", v)
+				}
+			},
+		},
+		{
+			name: "ResolveJSONWebKeys caches the key set of the long location",
+			test: func(t *testing.T, env *storageTestEnv) {
+				jwks := newTestJSONWebKeySet(t, "key-1")
+				var fetches int32
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					atomic.AddInt32(&fetches, 1)
+					w.Header().Set("Content-Type", "application/json")
+					_ = json.NewEncoder(w).Encode(jwks)
+				}))
+				defer server.Close()
+
+				// the location is longer than key names of Datastore.
+				location := server.URL + "/jwks.json?tenant=" + strings.Repeat("a", 2000)
+				for i := 0; i < 2; i++ {
+					got, err := env.store.ResolveJSONWebKeys(env.ctx, location, false)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(got.Key("key-1")) != 1 {
+						t.Fatalf("unexpected keys: %+v", got)
+					}
+				}
+				if v := atomic.LoadInt32(&fetches); v != 1 {
+					t.Errorf("the cached key set must be used: %d", v)
+				}
+			},
+		},
+		{
+			name: "JWKSFetcherStrategy limits the size and the time of fetches",
+			configure: func(config *Config) {
+				config.JWKSResolverOptions = &JWKSResolverOptions{
+					MaxResponseSize: 16,
+					Timeout:         50 * time.Millisecond,
+				}
+			},
+			test: func(t *testing.T, env *storageTestEnv) {
+				s := env.store.(*datastoreStorage)
+				if s.jwksResolverOptions.HTTPClient.Timeout == 0 {
+					t.Error("the default HTTP client must have the timeout")
+				}
+
+				done := make(chan struct{})
+				defer close(done)
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path == "/slow" {
+						select {
+						case <-done:
+						case <-r.Context().Done():
+						}
+						return
+					}
+					_, _ = w.Write([]byte(`{"keys":[],"padding":"exceeds the limit"}`))
+				}))
+				defer server.Close()
+
+				strategy := env.store.JWKSFetcherStrategy(env.ctx)
+				_, err := strategy.Resolve(server.URL+"/large", false)
+				if err == nil {
+					t.Error("the large key set must be rejected")
+				}
+
+				start := time.Now()
+				_, err = strategy.Resolve(server.URL+"/slow", false)
+				if err == nil {
+					t.Error("the slow fetch must time out")
+				}
+				if elapsed := time.Since(start); time.Second < elapsed {
+					t.Errorf("the fetch is not bounded by Timeout: %s", elapsed)
+				}
+			},
+		},
+	})
+}
+
+func newTestJSONWebKeySet(t *testing.T, kid string) *jose.JSONWebKeySet {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{
+			{
+				Key:       &key.PublicKey,
+				KeyID:     kid,
+				Algorithm: "ES256",
+				Use:       "sig",
+			},
+		},
+	}
+}
+
+// taggedRequester is the custom requester that stores Tag in addition to DefaultRequester.
+type taggedRequester struct {
+	DefaultRequester
+	Tag string
+}
+
+func (r *taggedRequester) Load(ctx context.Context, ps []datastore.Property) error {
+	var rest []datastore.Property
+	for _, p := range ps {
+		if p.Name == "Tag" {
+			r.Tag, _ = p.Value.(string)
+			continue
+		}
+		rest = append(rest, p)
+	}
+	return r.DefaultRequester.Load(ctx, rest)
+}
+
+func (r *taggedRequester) Save(ctx context.Context) ([]datastore.Property, error) {
+	ps, err := r.DefaultRequester.Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(ps, datastore.Property{Name: "Tag", Value: r.Tag}), nil
+}
+
+// prefixHasher is the custom PasswordHasher that stores the password with the prefix.
+type prefixHasher struct {
+	Prefix   string
+	Compares int
+}
+
+func (h *prefixHasher) Hash(password string) (string, error) {
+	return h.Prefix + password, nil
+}
+
+func (h *prefixHasher) Compare(hash string, password string) error {
+	h.Compares++
+	if !strings.HasPrefix(hash, h.Prefix) {
+		return errInvalidPasswordHash
+	}
+	if hash != h.Prefix+password {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+func TestArgon2Hasher(t *testing.T) {
+	hasher := &Argon2Hasher{Memory: 1024}
+	hash, err := hasher.Hash("pass-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hasher.Compare(hash, "pass-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hasher.Compare(hash, "wrong")
+	if err != ErrPasswordMismatch {
+		t.Fatalf("ErrPasswordMismatch is expected, but: %v", err)
+	}
+
+	_, err = (&Argon2Hasher{Memory: argon2MaxMemory + 1}).Hash("pass-a")
+	if err == nil {
+		t.Fatal("too large memory is accepted")
+	}
+
+	const salt = "c2FsdHNhbHRzYWx0c2FsdA"
+	for _, hash := range []string{
+		"$argon2id$v=19$m=1024,t=0,p=1$" + salt + "$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=0$" + salt + "$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$",
+		"$argon2id$v=19$m=4294967295,t=1,p=1$" + salt + "$a2V5",
+		"$argon2id$v=18$m=1024,t=1,p=1$" + salt + "$a2V5",
+		"$2a$10$invalid",
+	} {
+		err := hasher.Compare(hash, "pass-a")
+		if err != errInvalidPasswordHash {
+			t.Errorf("%s: errInvalidPasswordHash is expected, but: %v", hash, err)
+		}
+	}
+}
+
+// TestStorage_InAndOutOfTransaction runs each method outside BeginTX and in its own transaction,
+// with every requester type of Config.NewRequester.
+func TestStorage_InAndOutOfTransaction(t *testing.T) {
+	requesters := []struct {
+		name         string
+		newRequester func() fosite.Requester
+	}{
+		{"DefaultRequester", func() fosite.Requester { return &DefaultRequester{} }},
+		{"fosite.Request", func() fosite.Requester { return &fosite.Request{} }},
+		{"fosite.AccessRequest", func() fosite.Requester { return &fosite.AccessRequest{} }},
+		// it had called tx.Get with the nil transaction outside BeginTX.
+		{"fosite.AuthorizeRequest", func() fosite.Requester { return &fosite.AuthorizeRequest{} }},
+	}
+
+	var cases []*storageTestCase
+	for _, requester := range requesters {
+		for _, inTx := range []bool{false, true} {
+			requester, inTx := requester, inTx
+			name := requester.name + "/outside BeginTX"
+			if inTx {
+				name = requester.name + "/in BeginTX"
+			}
+			cases = append(cases, &storageTestCase{
+				name: name,
+				configure: func(config *Config) {
+					config.NewRequester = requester.newRequester
+				},
+				test: func(t *testing.T, env *storageTestEnv) {
+					// do runs fn in its own transaction if inTx, memdatastore doesn't read the writes of the transaction.
+					do := func(fn func(ctx context.Context) error) error {
+						if !inTx {
+							return fn(env.ctx)
+						}
+						txCtx, err := env.store.BeginTX(env.ctx)
+						if err != nil {
+							t.Fatal(err)
+						}
+						err = fn(txCtx)
+						if err != nil {
+							if rbErr := env.store.Rollback(txCtx); rbErr != nil {
+								t.Fatal(rbErr)
+							}
+							return err
+						}
+						return env.store.Commit(txCtx)
+					}
+					must := func(fn func(ctx context.Context) error) {
+						t.Helper()
+						if err := do(fn); err != nil {
+							t.Fatal(err)
+						}
+					}
+					get := func(fn func(ctx context.Context) (fosite.Requester, error)) fosite.Requester {
+						t.Helper()
+						var request fosite.Requester
+						must(func(ctx context.Context) error {
+							var err error
+							request, err = fn(ctx)
+							return err
+						})
+						return request
+					}
+
+					client := newTestClient("client-a")
+					must(func(ctx context.Context) error { return env.store.CreateClient(ctx, client) })
+					must(func(ctx context.Context) error {
+						_, err := env.store.GetClient(ctx, "client-a")
+						return err
+					})
+					must(func(ctx context.Context) error { return env.store.UpdateClient(ctx, client) })
+					request := newTestRequest("req-a", client, "user-a")
+
+					must(func(ctx context.Context) error { return env.store.CreateAuthorizeCodeSession(ctx, "code-a", request) })
+					got := get(func(ctx context.Context) (fosite.Requester, error) {
+						return env.store.GetAuthorizeCodeSession(ctx, "code-a", &openid.DefaultSession{})
+					})
+					assertRequest(t, got, "req-a", "client-a", "user-a")
+					must(func(ctx context.Context) error { return env.store.InvalidateAuthorizeCodeSession(ctx, "code-a") })
+					err := do(func(ctx context.Context) error {
+						_, err := env.store.GetAuthorizeCodeSession(ctx, "code-a", &openid.DefaultSession{})
+						return err
+					})
+					if errors.Cause(err) != fosite.ErrInvalidatedAuthorizeCode {
+						t.Fatalf("fosite.ErrInvalidatedAuthorizeCode is expected, but: %v", err)
+					}
+
+					must(func(ctx context.Context) error { return env.store.CreateOpenIDConnectSession(ctx, "code-a", request) })
+					got = get(func(ctx context.Context) (fosite.Requester, error) {
+						return env.store.GetOpenIDConnectSession(ctx, "code-a", &fosite.Request{Session: &openid.DefaultSession{}})
+					})
+					assertRequest(t, got, "req-a", "client-a", "user-a")
+					must(func(ctx context.Context) error { return env.store.DeleteOpenIDConnectSession(ctx, "code-a") })
+
+					must(func(ctx context.Context) error { return env.store.CreatePKCERequestSession(ctx, "code-a", request) })
+					got = get(func(ctx context.Context) (fosite.Requester, error) {
+						return env.store.GetPKCERequestSession(ctx, "code-a", &openid.DefaultSession{})
+					})
+					assertRequest(t, got, "req-a", "client-a", "user-a")
+					must(func(ctx context.Context) error { return env.store.DeletePKCERequestSession(ctx, "code-a") })
+
+					must(func(ctx context.Context) error { return env.store.CreateAccessTokenSession(ctx, "at-a", request) })
+					got = get(func(ctx context.Context) (fosite.Requester, error) {
+						return env.store.GetAccessTokenSession(ctx, "at-a", &openid.DefaultSession{})
+					})
+					assertRequest(t, got, "req-a", "client-a", "user-a")
+					must(func(ctx context.Context) error { return env.store.DeleteAccessTokenSession(ctx, "at-a") })
+
+					must(func(ctx context.Context) error { return env.store.CreateRefreshTokenSession(ctx, "rt-a", request) })
+					got = get(func(ctx context.Context) (fosite.Requester, error) {
+						return env.store.GetRefreshTokenSession(ctx, "rt-a", &openid.DefaultSession{})
+					})
+					assertRequest(t, got, "req-a", "client-a", "user-a")
+					must(func(ctx context.Context) error { return env.store.DeleteRefreshTokenSession(ctx, "rt-a") })
+
+					must(func(ctx context.Context) error { return env.store.CreateAccessTokenSession(ctx, "at-b", request) })
+					must(func(ctx context.Context) error { return env.store.CreateRefreshTokenSession(ctx, "rt-b", request) })
+					must(func(ctx context.Context) error { return env.store.RevokeAccessToken(ctx, "req-a") })
+					must(func(ctx context.Context) error { return env.store.RevokeRefreshToken(ctx, "req-a") })
+					err = do(func(ctx context.Context) error {
+						_, err := env.store.GetAccessTokenSession(ctx, "at-b", &openid.DefaultSession{})
+						return err
+					})
+					assertNotFound(t, err)
+
+					must(func(ctx context.Context) error { return env.store.DeleteClient(ctx, "client-a") })
+					err = do(func(ctx context.Context) error {
+						_, err := env.store.GetClient(ctx, "client-a")
+						return err
+					})
+					assertNotFound(t, err)
+				},
+			})
+		}
+	}
+
+	runStorageTests(t, cases)
+}
+
+type testTenantKey struct{}
+
+// TestStorage_Namespace writes entities in the namespace of tenant A, and looks them up from tenant B.
+func TestStorage_Namespace(t *testing.T) {
+	configure := func(config *Config) {
+		config.Namespace = func(ctx context.Context) string {
+			tenant, _ := ctx.Value(testTenantKey{}).(string)
+			return tenant
+		}
+	}
+	withCache := func(config *Config) {
+		configure(config)
+		cache, err := NewLRUClientCache(10, time.Minute)
+		if err != nil {
+			panic(err)
+		}
+		config.ClientCache = cache
+	}
+
+	test := func(t *testing.T, env *storageTestEnv) {
+		ctxA := context.WithValue(env.ctx, testTenantKey{}, "tenant-a")
+		ctxB := context.WithValue(env.ctx, testTenantKey{}, "tenant-b")
+
+		client := newTestClient("client-a")
+		err := env.store.CreateClient(ctxA, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := newTestRequest("req-a", client, "user-a")
+		err = env.store.CreateAuthorizeCodeSession(ctxA, "code-a", request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = env.store.CreateOpenIDConnectSession(ctxA, "code-a", request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = env.store.CreatePKCERequestSession(ctxA, "code-a", request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = env.store.CreateAccessTokenSession(ctxA, "at-a", request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = env.store.CreateRefreshTokenSession(ctxA, "rt-a", request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// fill the client cache of tenant A.
+		_, err = env.store.GetClient(ctxA, "client-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lookups := []struct {
+			name string
+			get  func(ctx context.Context) error
+		}{
+			{"GetClient", func(ctx context.Context) error {
+				_, err := env.store.GetClient(ctx, "client-a")
+				return err
+			}},
+			{"GetAuthorizeCodeSession", func(ctx context.Context) error {
+				_, err := env.store.GetAuthorizeCodeSession(ctx, "code-a", &openid.DefaultSession{})
+				return err
+			}},
+			{"GetOpenIDConnectSession", func(ctx context.Context) error {
+				_, err := env.store.GetOpenIDConnectSession(ctx, "code-a", &fosite.Request{Session: &openid.DefaultSession{}})
+				return err
+			}},
+			{"GetPKCERequestSession", func(ctx context.Context) error {
+				_, err := env.store.GetPKCERequestSession(ctx, "code-a", &openid.DefaultSession{})
+				return err
+			}},
+			{"GetAccessTokenSession", func(ctx context.Context) error {
+				_, err := env.store.GetAccessTokenSession(ctx, "at-a", &openid.DefaultSession{})
+				return err
+			}},
+			{"GetRefreshTokenSession", func(ctx context.Context) error {
+				_, err := env.store.GetRefreshTokenSession(ctx, "rt-a", &openid.DefaultSession{})
+				return err
+			}},
+		}
+		for _, lookup := range lookups {
+			err := lookup.get(ctxB)
+			if errors.Cause(err) != fosite.ErrNotFound {
+				t.Errorf("%s: fosite.ErrNotFound is expected from the other tenant, but: %v", lookup.name, err)
+			}
+		}
+
+		// revocation by the request ID is scoped too.
+		err = env.store.RevokeRefreshToken(ctxB, "req-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = env.store.RevokeAccessToken(ctxB, "req-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, lookup := range lookups {
+			err := lookup.get(ctxA)
+			if err != nil {
+				t.Errorf("%s: %v", lookup.name, err)
+			}
+		}
+	}
+
+	runStorageTests(t, []*storageTestCase{
+		{
+			name:      "without ClientCache",
+			configure: configure,
+			test:      test,
+		},
+		{
+			name:      "with ClientCache",
+			configure: withCache,
+			test:      test,
+		},
+	})
+}
+
+// TestStorage_RequestAncestorKeyLayout checks revocation by the entity group and the lifecycle of its members.
+func TestStorage_RequestAncestorKeyLayout(t *testing.T) {
+	ancestorLayout := func(config *Config) {
+		config.KeyLayout = RequestAncestorKeyLayout
+	}
+	countMembers := func(t *testing.T, env *storageTestEnv) int {
+		t.Helper()
+
+		s := env.store.(*datastoreStorage)
+		acc, err := s.accessor(env.ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, err := acc.client.Count(env.ctx, acc.NewQuery(s.RequestGroupMemberKind))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	runStorageTests(t, []*storageTestCase{
+		{
+			name:      "DeleteClient in the transaction with more tokens than a transaction allows",
+			configure: ancestorLayout,
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+				for i := 0; i < 300; i++ {
+					request := newTestRequest(fmt.Sprintf("req-%d", i), client, "user-a")
+					err := env.store.CreateAccessTokenSession(env.ctx, fmt.Sprintf("at-%d", i), request)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				if v := countMembers(t, env); v != 300 {
+					t.Fatalf("unexpected members: %d", v)
+				}
+
+				err := env.store.RunInTransaction(env.ctx, func(ctx context.Context) error {
+					return env.store.DeleteClient(ctx, "client-a")
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = env.store.GetClient(env.ctx, "client-a")
+				assertNotFound(t, err)
+				_, err = env.store.GetAccessTokenSession(env.ctx, "at-0", &openid.DefaultSession{})
+				assertNotFound(t, err)
+				if v := countMembers(t, env); v != 0 {
+					t.Fatalf("unexpected members: %d", v)
+				}
+			},
+		},
+		{
+			name:      "revocation by ancestor query",
+			configure: ancestorLayout,
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+				request := newTestRequest("req-a", client, "user-a")
+
+				txCtx, err := env.store.BeginTX(env.ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreateAccessTokenSession(txCtx, "at-a", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreateRefreshTokenSession(txCtx, "rt-a", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.Commit(txCtx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v := countMembers(t, env); v != 2 {
+					t.Fatalf("unexpected members: %d", v)
+				}
+
+				err = env.store.RevokeRefreshToken(env.ctx, "req-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = env.store.GetAccessTokenSession(env.ctx, "at-a", &openid.DefaultSession{})
+				assertNotFound(t, err)
+				_, err = env.store.GetRefreshTokenSession(env.ctx, "rt-a", &openid.DefaultSession{})
+				assertNotFound(t, err)
+				// the member of the inactive refresh token is retained with it.
+				if v := countMembers(t, env); v != 1 {
+					t.Fatalf("unexpected members: %d", v)
+				}
+
+				counts, err := env.store.PurgeExpired(env.ctx, time.Now().Add(31*24*time.Hour), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s := env.store.(*datastoreStorage)
+				if v := counts[s.RefreshTokenKind]; v != 1 {
+					t.Errorf("unexpected count: %d", v)
+				}
+				if v := counts[s.RequestGroupMemberKind]; v != 1 {
+					t.Errorf("unexpected count of members: %d", v)
+				}
+			},
+		},
+		{
+			name: "revocation of entities stored by FlatKeyLayout",
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+				request := newTestRequest("req-a", client, "user-a")
+
+				err := env.store.CreateAccessTokenSession(env.ctx, "at-a", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				ancestor := env.newStorage(t, ancestorLayout)
+				err = ancestor.CreateAccessTokenSession(env.ctx, "at-b", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = ancestor.RevokeAccessToken(env.ctx, "req-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, sig := range []string{"at-a", "at-b"} {
+					_, err := ancestor.GetAccessTokenSession(env.ctx, sig, &openid.DefaultSession{})
+					assertNotFound(t, err)
+				}
+				if v := countMembers(t, env); v != 0 {
+					t.Fatalf("unexpected members: %d", v)
+				}
+			},
+		},
+		{
+			name:      "members are deleted with the request entity",
+			configure: ancestorLayout,
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+				request := newTestRequest("req-a", client, "user-a")
+
+				err := env.store.CreateAccessTokenSession(env.ctx, "at-a", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreatePKCERequestSession(env.ctx, "code-a", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v := countMembers(t, env); v != 2 {
+					t.Fatalf("unexpected members: %d", v)
+				}
+
+				err = env.store.DeleteAccessTokenSession(env.ctx, "at-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.DeletePKCERequestSession(env.ctx, "code-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v := countMembers(t, env); v != 0 {
+					t.Fatalf("unexpected members: %d", v)
+				}
+			},
+		},
+		{
+			name:      "members are deleted by DeleteClient",
+			configure: ancestorLayout,
+			test: func(t *testing.T, env *storageTestEnv) {
+				client := mustCreateClient(t, env, "client-a")
+
+				err := env.store.CreateAccessTokenSession(env.ctx, "at-a", newTestRequest("req-a", client, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = env.store.CreateRefreshTokenSession(env.ctx, "rt-a", newTestRequest("req-a", client, "user-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v := countMembers(t, env); v != 2 {
+					t.Fatalf("unexpected members: %d", v)
+				}
+
+				err = env.store.DeleteClient(env.ctx, "client-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v := countMembers(t, env); v != 0 {
+					t.Fatalf("unexpected members: %d", v)
+				}
+			},
+		},
+	})
+}
+
+// TestStorage_ClientRoundTrip stores every field of each client type of Config.NewClientEntity, and reads them back.
+func TestStorage_ClientRoundTrip(t *testing.T) {
+	secret, err := bcrypt.GenerateFromPassword([]byte("client-a-secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotatedSecret, err := bcrypt.GenerateFromPassword([]byte("client-a-old-secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := newTestJSONWebKeySet(t, "kid-a")
+	now := time.Now().UTC().Truncate(time.Second)
+
+	newFositeClient := func() *fosite.DefaultClient {
+		return &fosite.DefaultClient{
+			ID:            "client-a",
+			Secret:        secret,
+			RedirectURIs:  []string{"https://client-a.example.com/callback", "https://client-a.example.com/callback2"},
+			GrantTypes:    []string{"authorization_code", "refresh_token", "client_credentials"},
+			ResponseTypes: []string{"code", "id_token"},
+			Scopes:        []string{"openid", "offline"},
+			Audience:      []string{"https://api.example.com"},
+			Public:        true,
+		}
+	}
+	newOpenIDConnectClient := func() *fosite.DefaultOpenIDConnectClient {
+		return &fosite.DefaultOpenIDConnectClient{
+			DefaultClient:                 newFositeClient(),
+			JSONWebKeysURI:                "https://client-a.example.com/jwks.json",
+			JSONWebKeys:                   jwks,
+			TokenEndpointAuthMethod:       "private_key_jwt",
+			RequestURIs:                   []string{"https://client-a.example.com/request.jwt"},
+			RequestObjectSigningAlgorithm: "ES256",
+		}
+	}
+	newDefaultClient := func() *DefaultClient {
+		fositeClient := newFositeClient()
+		return &DefaultClient{
+			ID:                fositeClient.ID,
+			Secret:            fositeClient.Secret,
+			RedirectURIs:      fositeClient.RedirectURIs,
+			GrantTypes:        fositeClient.GrantTypes,
+			ResponseTypes:     fositeClient.ResponseTypes,
+			Scopes:            fositeClient.Scopes,
+			Audience:          fositeClient.Audience,
+			Public:            fositeClient.Public,
+			ResponseModes:     []string{"query", "form_post"},
+			SecretActivatedAt: now,
+			RotatedSecrets: []ClientSecret{
+				{Hash: string(rotatedSecret), ActivatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)},
+			},
+			Lifespans: ClientLifespans{
+				AuthorizationCodeGrantAccessTokenLifespan:  1 * time.Minute,
+				AuthorizationCodeGrantIDTokenLifespan:      2 * time.Minute,
+				AuthorizationCodeGrantRefreshTokenLifespan: 3 * time.Minute,
+				ClientCredentialsGrantAccessTokenLifespan:  4 * time.Minute,
+				ImplicitGrantAccessTokenLifespan:           5 * time.Minute,
+				ImplicitGrantIDTokenLifespan:               6 * time.Minute,
+				PasswordGrantAccessTokenLifespan:           7 * time.Minute,
+				PasswordGrantRefreshTokenLifespan:          8 * time.Minute,
+				RefreshTokenGrantIDTokenLifespan:           9 * time.Minute,
+				RefreshTokenGrantAccessTokenLifespan:       10 * time.Minute,
+				RefreshTokenGrantRefreshTokenLifespan:      11 * time.Minute,
+			},
+			JSONWebKeysURI:                    "https://client-a.example.com/jwks.json",
+			JSONWebKeys:                       jwks,
+			TokenEndpointAuthMethod:           "private_key_jwt",
+			RequestURIs:                       []string{"https://client-a.example.com/request.jwt"},
+			RequestObjectSigningAlgorithm:     "ES256",
+			TokenEndpointAuthSigningAlgorithm: "ES256",
+		}
+	}
+
+	timeString := func(t time.Time) string {
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	lifespanGrants := []struct {
+		grantType string
+		tokenType fosite.TokenType
+	}{
+		{"authorization_code", fosite.AccessToken},
+		{"authorization_code", fosite.IDToken},
+		{"authorization_code", fosite.RefreshToken},
+		{"client_credentials", fosite.AccessToken},
+		{"implicit", fosite.AccessToken},
+		{"implicit", fosite.IDToken},
+		{"password", fosite.AccessToken},
+		{"password", fosite.RefreshToken},
+		{"refresh_token", fosite.IDToken},
+		{"refresh_token", fosite.AccessToken},
+		{"refresh_token", fosite.RefreshToken},
+	}
+
+	// fields returns nil if the client doesn't provide the field.
+	fields := []struct {
+		name string
+		get  func(client fosite.Client) interface{}
+	}{
+		{"ID", func(client fosite.Client) interface{} { return client.GetID() }},
+		{"Secret", func(client fosite.Client) interface{} { return string(client.GetHashedSecret()) }},
+		{"RedirectURIs", func(client fosite.Client) interface{} { return client.GetRedirectURIs() }},
+		{"GrantTypes", func(client fosite.Client) interface{} { return []string(client.GetGrantTypes()) }},
+		{"ResponseTypes", func(client fosite.Client) interface{} { return []string(client.GetResponseTypes()) }},
+		{"Scopes", func(client fosite.Client) interface{} { return []string(client.GetScopes()) }},
+		{"Audience", func(client fosite.Client) interface{} { return []string(client.GetAudience()) }},
+		{"Public", func(client fosite.Client) interface{} { return client.IsPublic() }},
+		{"JSONWebKeysURI", func(client fosite.Client) interface{} {
+			if c, ok := client.(fosite.OpenIDConnectClient); ok {
+				return c.GetJSONWebKeysURI()
+			}
+			return nil
+		}},
+		{"JSONWebKeys", func(client fosite.Client) interface{} {
+			if c, ok := client.(fosite.OpenIDConnectClient); ok {
+				b, err := json.Marshal(c.GetJSONWebKeys())
+				if err != nil {
+					t.Fatal(err)
+				}
+				return string(b)
+			}
+			return nil
+		}},
+		{"TokenEndpointAuthMethod", func(client fosite.Client) interface{} {
+			if c, ok := client.(fosite.OpenIDConnectClient); ok {
+				return c.GetTokenEndpointAuthMethod()
+			}
+			return nil
+		}},
+		{"RequestURIs", func(client fosite.Client) interface{} {
+			if c, ok := client.(fosite.OpenIDConnectClient); ok {
+				return c.GetRequestURIs()
+			}
+			return nil
+		}},
+		{"RequestObjectSigningAlgorithm", func(client fosite.Client) interface{} {
+			if c, ok := client.(fosite.OpenIDConnectClient); ok {
+				return c.GetRequestObjectSigningAlgorithm()
+			}
+			return nil
+		}},
+		{"TokenEndpointAuthSigningAlgorithm", func(client fosite.Client) interface{} {
+			if c, ok := client.(fosite.OpenIDConnectClient); ok {
+				return c.GetTokenEndpointAuthSigningAlgorithm()
+			}
+			return nil
+		}},
+		{"ResponseModes", func(client fosite.Client) interface{} {
+			if c, ok := client.(ResponseModeClient); ok {
+				return c.GetResponseModes()
+			}
+			return nil
+		}},
+		{"SecretActivatedAt", func(client fosite.Client) interface{} {
+			if c, ok := client.(*DefaultClient); ok {
+				return timeString(c.SecretActivatedAt)
+			}
+			return nil
+		}},
+		{"RotatedSecrets", func(client fosite.Client) interface{} {
+			c, ok := client.(*DefaultClient)
+			if !ok {
+				return nil
+			}
+			var secrets []string
+			for _, secret := range c.RotatedSecrets {
+				secrets = append(secrets, secret.Hash, timeString(secret.ActivatedAt), timeString(secret.ExpiresAt))
+			}
+			return secrets
+		}},
+		{"Lifespans", func(client fosite.Client) interface{} {
+			c, ok := client.(TokenLifespanClient)
+			if !ok {
+				return nil
+			}
+			var lifespans []time.Duration
+			for _, grant := range lifespanGrants {
+				lifespans = append(lifespans, c.GetEffectiveLifespan(grant.grantType, grant.tokenType, -1))
+			}
+			return lifespans
+		}},
+	}
+
+	entities := []struct {
+		name            string
+		newClientEntity func() fosite.Client
+		client          func() fosite.Client
+		configure       func(config *Config)
+	}{
+		{
+			name:            "fosite.DefaultClient",
+			newClientEntity: func() fosite.Client { return &fosite.DefaultClient{} },
+			client:          func() fosite.Client { return newFositeClient() },
+		},
+		{
+			name:            "fosite.DefaultOpenIDConnectClient",
+			newClientEntity: func() fosite.Client { return &fosite.DefaultOpenIDConnectClient{} },
+			client:          func() fosite.Client { return newOpenIDConnectClient() },
+		},
+		{
+			name:            "DefaultClient",
+			newClientEntity: func() fosite.Client { return &DefaultClient{} },
+			client:          func() fosite.Client { return newDefaultClient() },
+		},
+		{
+			name:            "DefaultClient with Encrypter and ClientCache",
+			newClientEntity: func() fosite.Client { return &DefaultClient{} },
+			client:          func() fosite.Client { return newDefaultClient() },
+			configure: func(config *Config) {
+				config.Encrypter = &EnvelopeEncrypter{
+					KeyProvider: &FileKeyProvider{
+						Current: "key-a",
+						Keys:    map[string][]byte{"key-a": make([]byte, 32)},
+					},
+				}
+				cache, err := NewLRUClientCache(10, time.Minute)
+				if err != nil {
+					t.Fatal(err)
+				}
+				config.ClientCache = cache
+			},
+		},
+	}
+
+	var cases []*storageTestCase
+	for _, entity := range entities {
+		entity := entity
+		cases = append(cases, &storageTestCase{
+			name: entity.name,
+			configure: func(config *Config) {
+				config.NewClientEntity = entity.newClientEntity
+				if entity.configure != nil {
+					entity.configure(config)
+				}
+			},
+			test: func(t *testing.T, env *storageTestEnv) {
+				want := entity.client()
+				err := env.store.CreateClient(env.ctx, entity.client())
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				loaded := make(map[string]fosite.Client)
+				for i := 0; i < 2; i++ {
+					// the second one is from ClientCache if it is configured.
+					client, err := env.store.GetClient(env.ctx, "client-a")
+					if err != nil {
+						t.Fatal(err)
+					}
+					loaded[fmt.Sprintf("GetClient#%d", i+1)] = client
+				}
+				clients, _, err := env.store.ListClients(env.ctx, "", 10)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(clients) != 1 {
+					t.Fatalf("unexpected clients: %d", len(clients))
+				}
+				loaded["ListClients"] = clients[0]
+
+				for by, client := range loaded {
+					for _, field := range fields {
+						got, expected := field.get(client), field.get(want)
+						if !reflect.DeepEqual(got, expected) {
+							t.Errorf("%s: %s: expected %v, but: %v", by, field.name, expected, got)
+						}
+					}
+				}
+			},
+		})
+	}
+	runStorageTests(t, cases)
+}
@@ -0,0 +1,142 @@
+package fdsstorage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+	"golang.org/x/xerrors"
+)
+
+// txState is the transaction shared by BeginTX and the joined BeginTX.
+type txState struct {
+	tx datastore.Transaction
+
+	mu   sync.Mutex
+	done bool
+	// rollbackOnly is set by Rollback of the joined context. Commit rolls back the transaction instead.
+	rollbackOnly bool
+	// afterCommit are called after the transaction is committed successfully.
+	afterCommit []func()
+}
+
+// txContext is stored in the context by BeginTX.
+type txContext struct {
+	state *txState
+	// joined is true if BeginTX is called in the active transaction.
+	// Commit and Rollback of the joined context are left to the outermost one.
+	joined bool
+}
+
+// activeTxContext returns txContext of ctx if it has the transaction that isn't committed nor rolled back.
+func activeTxContext(ctx context.Context) (*txContext, bool) {
+	txCtx, ok := ctx.Value(contextTxKey{}).(*txContext)
+	if !ok || txCtx == nil {
+		return nil, false
+	}
+	txCtx.state.mu.Lock()
+	defer txCtx.state.mu.Unlock()
+	if txCtx.state.done {
+		return nil, false
+	}
+	return txCtx, true
+}
+
+// txFromContext returns the active transaction of ctx, or nil if ctx has no transaction.
+// it returns an error if the transaction of ctx has been committed or rolled back,
+// otherwise the call would silently run out of the transaction.
+func txFromContext(ctx context.Context) (datastore.Transaction, error) {
+	txCtx, ok := ctx.Value(contextTxKey{}).(*txContext)
+	if !ok || txCtx == nil {
+		return nil, nil
+	}
+	txCtx.state.mu.Lock()
+	defer txCtx.state.mu.Unlock()
+	if txCtx.state.done {
+		return nil, errors.WithStack(errFinishedTxContext)
+	}
+	return txCtx.state.tx, nil
+}
+
+// finish marks the transaction as done. it returns false if it has been done already.
+func (state *txState) finish() bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.done {
+		return false
+	}
+	state.done = true
+	return true
+}
+
+// markRollbackOnly makes the transaction never be committed.
+func (state *txState) markRollbackOnly() {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.rollbackOnly = true
+}
+
+// isRollbackOnly reports whether the transaction is marked by markRollbackOnly.
+func (state *txState) isRollbackOnly() bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.rollbackOnly
+}
+
+// onCommit registers fn to be called after the transaction is committed successfully.
+func (state *txState) onCommit(fn func()) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.afterCommit = append(state.afterCommit, fn)
+}
+
+// RunInTransaction runs fn in the transaction and commits it.
+// fn joins the transaction if ctx already has the active one, and it is committed by the owner of the transaction.
+// otherwise fn is retried on the contention of the transaction, see Config.TxMaxAttempts and Config.TxBackoff.
+func (s *datastoreStorage) RunInTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := activeTxContext(ctx); ok {
+		return fn(ctx)
+	}
+
+	var err error
+	for attempt := 0; attempt < s.txMaxAttempts; attempt++ {
+		if attempt != 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(s.txBackoff(attempt)):
+			}
+		}
+
+		var txCtx context.Context
+		txCtx, err = s.BeginTX(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = fn(txCtx)
+		if err != nil {
+			rbErr := s.Rollback(txCtx)
+			if !xerrors.Is(err, datastore.ErrConcurrentTransaction) {
+				return err
+			} else if rbErr != nil {
+				return rbErr
+			}
+			continue
+		}
+
+		err = s.Commit(txCtx)
+		if !xerrors.Is(err, datastore.ErrConcurrentTransaction) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// defaultTxBackoff waits exponentially from 100ms.
+func defaultTxBackoff(attempt int) time.Duration {
+	return 100 * time.Millisecond << uint(attempt-1)
+}
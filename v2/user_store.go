@@ -0,0 +1,219 @@
+package fdsstorage
+
+import (
+	"context"
+	"time"
+
+	"github.com/ory/fosite"
+	"go.mercari.io/datastore"
+	"golang.org/x/xerrors"
+)
+
+var _ datastore.KeyLoader = (*User)(nil)
+var _ datastore.PropertyLoadSaver = (*User)(nil)
+
+// User is the resource owner stored in UserKind. its key name is the user name.
+type User struct {
+	Name           string    `datastore:"-"`
+	PasswordHash   string    `json:"-" datastore:",noindex"`
+	FailedAttempts int       ``
+	LastFailedAt   time.Time ``
+	LockedUntil    time.Time ``
+	UpdatedAt      time.Time ``
+	CreatedAt      time.Time ``
+}
+
+// LoadKey is restore user name from Datastore key.
+func (user *User) LoadKey(ctx context.Context, key datastore.Key) error {
+	user.Name = key.Name()
+	return nil
+}
+
+// Load loads all of the provided properties into *User.
+func (user *User) Load(ctx context.Context, ps []datastore.Property) error {
+	return datastore.LoadStruct(ctx, user, ps)
+}
+
+// Save saves all of *User's properties as a slice of Properties.
+func (user *User) Save(ctx context.Context) ([]datastore.Property, error) {
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now()
+	}
+	user.UpdatedAt = time.Now()
+
+	return datastore.SaveStruct(ctx, user)
+}
+
+// IsLocked reports whether the user is locked out at the time.
+func (user *User) IsLocked(now time.Time) bool {
+	return now.Before(user.LockedUntil)
+}
+
+// UserStoreOptions provides some settings for the built-in user store.
+type UserStoreOptions struct {
+	// Hasher hashes and verifies passwords. default is BCryptHasher.
+	// existing bcrypt and argon2id hashes which it can't verify are verified by the built-in hashers.
+	Hasher PasswordHasher
+	// MaxFailedAttempts locks the user out after the consecutive failures. default is 5.
+	MaxFailedAttempts int
+	// FailureWindow resets the failure counter after this duration from the last failure. default is 15 minutes.
+	FailureWindow time.Duration
+	// LockoutDuration is the duration of the lockout. default is 15 minutes.
+	LockoutDuration time.Duration
+}
+
+func (s *datastoreStorage) userKey(acc *dsAccessor, name string) datastore.Key {
+	return acc.NameKey(s.UserKind, name, nil)
+}
+
+// CreateUser creates the user with the password.
+func (s *datastoreStorage) CreateUser(ctx context.Context, name string, password string) error {
+	acc, err := s.accessor(ctx)
+	if err != nil {
+		return err
+	}
+
+	hash, err := s.userStoreOptions.Hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	key := s.userKey(acc, name)
+	return acc.RunInTransaction(func(tx datastore.Transaction) error {
+		err := tx.Get(key, &User{})
+		if err == nil {
+			return ErrUserAlreadyExists
+		} else if !xerrors.Is(err, datastore.ErrNoSuchEntity) {
+			return err
+		}
+
+		_, err = tx.Put(key, &User{
+			Name:         name,
+			PasswordHash: hash,
+		})
+		return err
+	})
+}
+
+// UpdateUserPassword changes the password of the user, and unlocks the user.
+func (s *datastoreStorage) UpdateUserPassword(ctx context.Context, name string, password string) error {
+	hash, err := s.userStoreOptions.Hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	return s.modifyUser(ctx, name, func(user *User) {
+		user.PasswordHash = hash
+		user.FailedAttempts = 0
+		user.LockedUntil = time.Time{}
+	})
+}
+
+// UnlockUser resets the failure counter and the lockout of the user.
+func (s *datastoreStorage) UnlockUser(ctx context.Context, name string) error {
+	return s.modifyUser(ctx, name, func(user *User) {
+		user.FailedAttempts = 0
+		user.LockedUntil = time.Time{}
+	})
+}
+
+// DeleteUser deletes the user.
+func (s *datastoreStorage) DeleteUser(ctx context.Context, name string) error {
+	acc, err := s.accessor(ctx)
+	if err != nil {
+		return err
+	}
+
+	return acc.Delete(s.userKey(acc, name))
+}
+
+// modifyUser updates the user in the transaction.
+func (s *datastoreStorage) modifyUser(ctx context.Context, name string, modify func(user *User)) error {
+	acc, err := s.accessor(ctx)
+	if err != nil {
+		return err
+	}
+
+	key := s.userKey(acc, name)
+	return acc.RunInTransaction(func(tx datastore.Transaction) error {
+		user := &User{}
+		err := tx.Get(key, user)
+		if xerrors.Is(err, datastore.ErrNoSuchEntity) {
+			return fosite.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+
+		modify(user)
+
+		_, err = tx.Put(key, user)
+		return err
+	})
+}
+
+// authenticateByUserStore verifies the password of the user stored in UserKind.
+// it returns fosite.ErrNotFound for unknown users and wrong passwords.
+// while the user is locked out, it returns ErrUserLocked wrapped as fosite.ErrNotFound,
+// so the token endpoint responds the same way as a wrong password and doesn't reveal the user exists.
+func (s *datastoreStorage) authenticateByUserStore(ctx context.Context, name string, secret string) error {
+	acc, err := s.accessor(ctx)
+	if err != nil {
+		return err
+	}
+	// the failure counter must be stored even if the caller rolls back its transaction.
+	acc = acc.NoTx()
+
+	opts := s.userStoreOptions
+	key := s.userKey(acc, name)
+	var authErr error
+	err = acc.RunInTransaction(func(tx datastore.Transaction) error {
+		authErr = nil
+
+		user := &User{}
+		err := tx.Get(key, user)
+		if xerrors.Is(err, datastore.ErrNoSuchEntity) {
+			_ = s.comparePasswordHash(s.dummyPasswordHash(), secret)
+			authErr = fosite.ErrNotFound
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if user.IsLocked(now) {
+			authErr = wrapNotFound(ErrUserLocked)
+			return nil
+		}
+
+		err = s.comparePasswordHash(user.PasswordHash, secret)
+		if err == ErrPasswordMismatch {
+			if !user.LastFailedAt.IsZero() && opts.FailureWindow < now.Sub(user.LastFailedAt) {
+				user.FailedAttempts = 0
+			}
+			user.FailedAttempts++
+			user.LastFailedAt = now
+			if opts.MaxFailedAttempts <= user.FailedAttempts {
+				user.FailedAttempts = 0
+				user.LockedUntil = now.Add(opts.LockoutDuration)
+			}
+			authErr = fosite.ErrNotFound
+		} else if err != nil {
+			// the hash that no hasher can verify fails as a wrong password, but isn't counted.
+			authErr = wrapNotFound(err)
+			return nil
+		} else if user.FailedAttempts == 0 && user.LockedUntil.IsZero() {
+			return nil
+		} else {
+			user.FailedAttempts = 0
+			user.LockedUntil = time.Time{}
+		}
+
+		_, err = tx.Put(key, user)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return authErr
+}